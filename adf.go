@@ -0,0 +1,227 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"context"
+	"errors"
+	"image/color"
+	"strings"
+	"time"
+)
+
+// Side identifies the side of a sheet an image was scanned from.
+type Side int
+
+// Side constants.
+const (
+	SideUnknown Side = iota // no information about the source
+	SideFront               // front side
+	SideBack                // back side
+)
+
+// sides returns a function that maps page indices to sides for the current
+// scan source. Pages from duplex sources alternate between front and back.
+func (c *Conn) sides() func(i int) Side {
+	v, err := c.GetOption("source")
+	src, ok := v.(string)
+	switch {
+	case err != nil || !ok:
+		return func(int) Side { return SideUnknown }
+	case strings.Contains(strings.ToLower(src), "duplex"):
+		return func(i int) Side {
+			if i%2 == 0 {
+				return SideFront
+			}
+			return SideBack
+		}
+	default:
+		return func(int) Side { return SideFront }
+	}
+}
+
+// DuplexMode describes the order in which a duplex scan returns pages.
+type DuplexMode int
+
+// DuplexMode constants.
+const (
+	DuplexInterleaved   DuplexMode = iota // front1, back1, front2, back2, ...
+	DuplexFrontsFirst                     // front1, front2, ..., back1, back2, ...
+	DuplexBacksReversed                   // front1, front2, ..., back2, back1
+)
+
+// ReorderDuplex returns the images of a duplex scan, returned in the order
+// given by mode, in document order: the front and back of the first sheet,
+// then those of the second sheet, and so on. The Side of each image is set
+// accordingly. With an odd number of images, the extra one is taken to be a
+// front.
+func ReorderDuplex(imgs []*Image, mode DuplexMode) []*Image {
+	n := len(imgs)
+	nf := (n + 1) / 2
+	out := make([]*Image, n)
+	for i := range out {
+		j := i
+		switch {
+		case mode == DuplexInterleaved:
+		case i%2 == 0:
+			j = i / 2
+		case mode == DuplexFrontsFirst:
+			j = nf + i/2
+		default:
+			j = n - 1 - i/2
+		}
+		out[i] = imgs[j]
+		out[i].Side = SideFront
+		if i%2 == 1 {
+			out[i].Side = SideBack
+		}
+	}
+	return out
+}
+
+// ErrDoubleFeed is returned by the feeder functions when double feed
+// detection is enabled and two sheets appear to have been fed at once.
+var ErrDoubleFeed = errors.New("sane: probable double feed")
+
+const (
+	doubleFeedLength = 1.5  // relative page length suggesting a double feed
+	doubleFeedDiff   = 0.02 // relative pixel difference below which pages match
+	doubleFeedGrid   = 32   // number of samples along each axis
+	doubleFeedBlank  = 0.01 // IsBlank threshold for pages not compared
+)
+
+// DetectDoubleFeed reports whether cur, the page scanned after prev, looks
+// like the result of a double feed. This is the case if cur is unexpectedly
+// long compared to prev, or if it is nearly identical to prev, unless both
+// are blank, as the backs of single-sided pages in a duplex scan often are.
+func DetectDoubleFeed(prev, cur *Image) bool {
+	pb, cb := prev.Bounds(), cur.Bounds()
+	if pb.Empty() || pb.Dx() != cb.Dx() {
+		return false // nothing to compare with
+	}
+	if float64(cb.Dy()) > doubleFeedLength*float64(pb.Dy()) {
+		return true
+	}
+	if pb.Dy() != cb.Dy() {
+		return false
+	}
+	if prev.IsBlank(doubleFeedBlank) && cur.IsBlank(doubleFeedBlank) {
+		return false
+	}
+	var diff float64
+	for i := 0; i < doubleFeedGrid; i++ {
+		for j := 0; j < doubleFeedGrid; j++ {
+			x := (2*i + 1) * pb.Dx() / (2 * doubleFeedGrid)
+			y := (2*j + 1) * pb.Dy() / (2 * doubleFeedGrid)
+			p := color.Gray16Model.Convert(prev.At(x, y)).(color.Gray16).Y
+			c := color.Gray16Model.Convert(cur.At(x, y)).(color.Gray16).Y
+			if p > c {
+				diff += float64(p - c)
+			} else {
+				diff += float64(c - p)
+			}
+		}
+	}
+	diff /= doubleFeedGrid * doubleFeedGrid * 0xffff
+	return diff < doubleFeedDiff
+}
+
+// SetDoubleFeedDetection enables or disables double feed detection in
+// ReadAvailableImages, ContinuousRead and Images. When enabled, they fail with
+// ErrDoubleFeed if DetectDoubleFeed reports a double feed for any two
+// consecutive pages; ReadAvailableImages also returns the pages read before
+// the suspect one.
+func (c *Conn) SetDoubleFeedDetection(enabled bool) {
+	c.detectDoubleFeed = enabled
+}
+
+// checkFeed returns ErrDoubleFeed if double feed detection is enabled and
+// cur looks like a double feed after prev, which may be nil.
+func (c *Conn) checkFeed(prev, cur *Image) error {
+	if c.detectDoubleFeed && prev != nil && DetectDoubleFeed(prev, cur) {
+		return ErrDoubleFeed
+	}
+	return nil
+}
+
+// Sensor options reporting whether the feeder holds paper, as named by
+// various backends.
+var docSensors = []string{"page-loaded", "document-loaded", "adf-loaded"}
+
+const docProbeInterval = time.Second
+
+// docSensor returns the name of the document sensor option, or the empty
+// string if the device has none.
+func (c *Conn) docSensor() string {
+	for _, name := range docSensors {
+		o := findOpt(c.Options(), name)
+		if o != nil && o.Type == TypeBool && o.IsDetectable {
+			return name
+		}
+	}
+	return ""
+}
+
+// hasDocuments reports whether the feeder holds paper. Without a sensor, it
+// starts and cancels a scan, which some devices answer by feeding a sheet.
+func (c *Conn) hasDocuments(sensor string) (bool, error) {
+	if sensor != "" {
+		v, err := c.GetOption(sensor)
+		if err != nil {
+			return false, err
+		}
+		return v.(bool), nil
+	}
+	err := c.Start()
+	c.Cancel()
+	if err == ErrEmpty {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Options reporting the number of sheets left in the feeder, as named by
+// various backends.
+var docCountOpts = []string{"page-count", "pages-remaining", "document-count"}
+
+// DocumentsRemaining returns the number of sheets left in the feeder, and
+// whether the device reports it. It returns 0, false if the device has no
+// such option, or if reading it fails.
+func (c *Conn) DocumentsRemaining() (int, bool) {
+	o := c.firstOpt(docCountOpts, TypeInt)
+	if o == nil || !o.IsDetectable {
+		return 0, false
+	}
+	v, err := c.GetOption(o.Name)
+	if err != nil {
+		return 0, false
+	}
+	n, ok := v.(int)
+	return n, ok
+}
+
+// WaitForDocuments blocks until the feeder holds paper or the context is done.
+// It reads the document sensor if the device has one, and otherwise probes
+// the feeder by periodically starting a scan.
+func (c *Conn) WaitForDocuments(ctx context.Context) error {
+	sensor := c.docSensor()
+	d := defaultPollInterval
+	if sensor == "" {
+		d = docProbeInterval
+	}
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		ok, err := c.hasDocuments(sensor)
+		if err != nil || ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
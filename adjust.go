@@ -0,0 +1,114 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import "math"
+
+// luma8 returns the 8-bit luminance of each pixel of the image, row by row.
+func (m *Image) luma8() []uint8 {
+	b := m.Bounds()
+	l := make([]uint8, 0, b.Dx()*b.Dy())
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			l = append(l, uint8(luma16(m.rgb16At(x, y))>>8))
+		}
+	}
+	return l
+}
+
+func threshold(w, h int, l []uint8, level uint8) *Image {
+	f := makeFrame(FrameGray, w, h, 1)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if l[y*w+x] >= level {
+				f.set(x, y, 0, 1) // white
+			}
+		}
+	}
+	return &Image{fs: [3]*Frame{f}}
+}
+
+// Threshold converts the image to a bilevel image, where pixels with a
+// luminance of at least level become white and all others black.
+func (m *Image) Threshold(level uint8) *Image {
+	b := m.Bounds()
+	n := threshold(b.Dx(), b.Dy(), m.luma8(), level)
+	n.Side = m.Side
+	return n
+}
+
+// ThresholdAuto is like Threshold, but chooses the level with Otsu's method,
+// which best separates dark and light pixels. It returns the bilevel image
+// and the level used.
+func (m *Image) ThresholdAuto() (*Image, uint8) {
+	b := m.Bounds()
+	l := m.luma8()
+	var hist [256]int
+	sum := 0.0
+	for _, v := range l {
+		hist[v]++
+		sum += float64(v)
+	}
+	// Maximize the between-class variance.
+	var (
+		best     uint8
+		bestVar  float64
+		nb, sumb float64
+		total    = float64(len(l))
+	)
+	for t := 0; t < 256; t++ {
+		nb += float64(hist[t])
+		if nb == 0 {
+			continue
+		}
+		nf := total - nb
+		if nf == 0 {
+			break
+		}
+		sumb += float64(t * hist[t])
+		mb, mf := sumb/nb, (sum-sumb)/nf
+		if v := nb * nf * (mb - mf) * (mb - mf); v > bestVar {
+			bestVar, best = v, uint8(t)
+		}
+	}
+	// Pixels up to and including best belong to the dark class.
+	level := best + 1
+	if bestVar == 0 {
+		level = best
+	}
+	n := threshold(b.Dx(), b.Dy(), l, level)
+	n.Side = m.Side
+	return n, level
+}
+
+// AdjustBrightnessContrast returns a copy of the image with the brightness
+// and contrast of each channel adjusted. Contrast scales samples around mid
+// gray by 1+contrast, so that -1 gives a flat gray image, and brightness then
+// shifts them by that fraction of the sample range, from -1 to 1. Zero leaves
+// either property unchanged. Results are clamped to the range of the sample
+// depth, which is preserved, except that bilevel images become 8-bit gray.
+func (m *Image) AdjustBrightnessContrast(brightness, contrast float64) *Image {
+	return m.mapFrames(func(f *Frame) *Frame {
+		depth, scale := f.Depth, 1.0
+		if depth == 1 {
+			depth, scale = 8, 0xff
+		}
+		max := float64(int(1)<<uint(depth) - 1)
+		mid := max / 2
+		g := makeFrame(f.Format, f.Width, f.Height, depth)
+		g.IsLast = f.IsLast
+		for y := 0; y < f.Height; y++ {
+			for x := 0; x < f.Width; x++ {
+				for ch := 0; ch < f.Channels; ch++ {
+					v := float64(f.AtUnchecked(x, y, ch)) * scale
+					v = (v-mid)*(1+contrast) + mid + brightness*max
+					v = math.Max(0, math.Min(max, math.Floor(v+0.5)))
+					g.set(x, y, ch, uint16(v))
+				}
+			}
+		}
+		return g
+	})
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image/png"
+	"io"
+	"math"
+)
+
+// An Encoder writes an image to w in some file format. Image methods such as
+// EncodePNM take their arguments the other way round, and are adapted with a
+// function literal:
+//
+//	enc := func(w io.Writer, m *Image) error { return m.EncodePNM(w) }
+type Encoder func(w io.Writer, m *Image) error
+
+// EncodePNG is an Encoder for the PNG format.
+func EncodePNG(w io.Writer, m *Image) error {
+	return png.Encode(w, m.StdImage())
+}
+
+// pngHeaderLen is the length of the PNG signature and IHDR chunk, which
+// always come first in a PNG file.
+const pngHeaderLen = 8 + 4 + 4 + 13 + 4
+
+// EncodePNGWithDPI returns an Encoder for the PNG format that records a
+// resolution of dpi in the pHYs chunk, so that the physical size of the page
+// is preserved. The resolution of a scan is given by Resolution or ScanMeta.
+func EncodePNGWithDPI(dpi int) Encoder {
+	return func(w io.Writer, m *Image) error {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, m.StdImage()); err != nil {
+			return err
+		}
+		b := buf.Bytes()
+		if _, err := w.Write(b[:pngHeaderLen]); err != nil {
+			return err
+		}
+		if _, err := w.Write(physChunk(dpi)); err != nil {
+			return err
+		}
+		_, err := w.Write(b[pngHeaderLen:])
+		return err
+	}
+}
+
+// physChunk returns a PNG pHYs chunk for a resolution of dpi in both
+// directions. PNG measures resolution in pixels per metre.
+func physChunk(dpi int) []byte {
+	ppm := uint32(math.Floor(float64(dpi)/0.0254 + 0.5))
+	b := make([]byte, 4+4+9+4)
+	binary.BigEndian.PutUint32(b[0:], 9)
+	copy(b[4:], "pHYs")
+	binary.BigEndian.PutUint32(b[8:], ppm)
+	binary.BigEndian.PutUint32(b[12:], ppm)
+	b[16] = 1 // unit is the metre
+	binary.BigEndian.PutUint32(b[17:], crc32.ChecksumIEEE(b[4:17]))
+	return b
+}
+
+// WriteZIP writes a ZIP archive to w with one file per image, encoded with
+// enc and named by nameFn, which receives the index of the image. If nameFn
+// is nil, files are named page-0001, page-0002 and so on. Each image is
+// encoded straight into the archive, so memory use does not grow with the
+// number of images.
+func WriteZIP(w io.Writer, imgs []*Image, enc Encoder, nameFn func(i int) string) error {
+	if nameFn == nil {
+		nameFn = func(i int) string {
+			return fmt.Sprintf("page-%04d", i+1)
+		}
+	}
+	zw := zip.NewWriter(w)
+	for i, m := range imgs {
+		fw, err := zw.Create(nameFn(i))
+		if err != nil {
+			return err
+		}
+		if err := enc(fw, m); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+const mmPerInch = 25.4
+
+// geomOpts are the names of the geometry options, in the order of the fields
+// of Rect.
+var geomOpts = [4]string{"tl-x", "tl-y", "br-x", "br-y"}
+
+// geomUnits returns the units of the geometry options, in the order of
+// geomOpts, checking that each is UnitMm or UnitPixel.
+func (c *Conn) geomUnits() (u [4]Unit, err error) {
+	for i, name := range geomOpts {
+		o := findOpt(c.Options(), name)
+		if o == nil {
+			return u, fmt.Errorf("no option named %s", name)
+		}
+		if o.Unit != UnitMm && o.Unit != UnitPixel {
+			return u, fmt.Errorf("option %s has unsupported unit %v", name, o.Unit)
+		}
+		u[i] = o.Unit
+	}
+	return u, nil
+}
+
+// resolutions returns the horizontal and vertical scan resolutions in DPI,
+// which are the same for devices with a single resolution option.
+func (c *Conn) resolutions() (dpi [2]int, err error) {
+	names, err := c.resolutionOpts()
+	if err != nil {
+		return dpi, err
+	}
+	for i := range dpi {
+		v, err := c.GetOption(names[i%len(names)])
+		if err != nil {
+			return dpi, err
+		}
+		dpi[i] = int(math.Floor(toFloat(v) + 0.5))
+	}
+	return dpi, nil
+}
+
+// convertGeom converts the value of geometry option i, in the order of
+// geomOpts, from one of UnitMm and UnitPixel to the other at the resolution
+// of its axis in dpi, and returns it unchanged if the units are the same.
+func convertGeom(i int, v float64, from, to Unit, dpi [2]int) float64 {
+	d := float64(dpi[i%2]) // tl-x, tl-y, br-x, br-y
+	switch {
+	case from == to:
+		return v
+	case to == UnitMm:
+		return v * mmPerInch / d
+	}
+	return v * d / mmPerInch
+}
+
+// geometry returns the values of the geometry options converted to unit,
+// which must be UnitMm or UnitPixel. Values in the other unit are converted
+// at the current resolution.
+func (c *Conn) geometry(unit Unit) (v [4]float64, err error) {
+	units, err := c.geomUnits()
+	if err != nil {
+		return v, err
+	}
+	var dpi [2]int
+	for i, name := range geomOpts {
+		x, err := c.GetOption(name)
+		if err != nil {
+			return v, err
+		}
+		if units[i] != unit && dpi[0] == 0 {
+			if dpi, err = c.resolutions(); err != nil {
+				return v, err
+			}
+		}
+		v[i] = convertGeom(i, toFloat(x), units[i], unit, dpi)
+	}
+	return v, nil
+}
+
+// ScanArea returns the current scan area in millimeters, whether the device
+// measures it in millimeters or in pixels. Pixels are converted at the
+// current resolution of each axis.
+func (c *Conn) ScanArea() (Rect, error) {
+	v, err := c.geometry(UnitMm)
+	if err != nil {
+		return Rect{}, err
+	}
+	return Rect{v[0], v[1], v[2], v[3]}, nil
+}
+
+// SetScanArea sets the scan area in millimeters, whether the device measures
+// it in millimeters or in pixels, snapping each edge to the nearest supported
+// value. Pixels are converted at the current resolution, so the resolution
+// should be set first.
+func (c *Conn) SetScanArea(r Rect) error {
+	if r.Left >= r.Right || r.Top >= r.Bottom {
+		return fmt.Errorf("invalid scan area %v", r)
+	}
+	units, err := c.geomUnits()
+	if err != nil {
+		return err
+	}
+	var dpi [2]int
+	for i, v := range [4]float64{r.Left, r.Top, r.Right, r.Bottom} {
+		if units[i] != UnitMm && dpi[0] == 0 {
+			if dpi, err = c.resolutions(); err != nil {
+				return err
+			}
+		}
+		v = convertGeom(i, v, UnitMm, units[i], dpi)
+		if _, _, err := c.SetOptionNearest(geomOpts[i], v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanAreaPixels is like ScanArea, but returns the scan area in pixels at the
+// current resolution, rounded to the nearest pixel.
+func (c *Conn) ScanAreaPixels() (image.Rectangle, error) {
+	v, err := c.geometry(UnitPixel)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	var p [4]int
+	for i := range v {
+		p[i] = int(math.Floor(v[i] + 0.5))
+	}
+	return image.Rect(p[0], p[1], p[2], p[3]), nil
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"context"
+	"time"
+)
+
+// Option names used by backends for calibration.
+var (
+	calibrateOpts   = []string{"calibrate", "calibrate-now", "calibration"}
+	calibStatusOpts = []string{"need-calibration", "calibrating"}
+)
+
+const calibrateInterval = 500 * time.Millisecond
+
+// Calibrate presses the calibration button of the device and blocks until
+// calibration is complete or the context is done. If the device reports its
+// calibration status, Calibrate waits for it to clear; otherwise it assumes
+// calibration is complete once the button press returns. It returns
+// ErrUnsupported if the device has no calibration button.
+func (c *Conn) Calibrate(ctx context.Context) error {
+	o := c.firstOpt(calibrateOpts, TypeButton)
+	if o == nil {
+		return ErrUnsupported
+	}
+	if err := c.PressButton(o.Name); err != nil {
+		return err
+	}
+	status := c.firstOpt(calibStatusOpts, TypeBool)
+	if status == nil {
+		return nil
+	}
+	t := time.NewTicker(calibrateInterval)
+	defer t.Stop()
+	for {
+		v, err := c.GetOption(status.Name)
+		if err != nil || !v.(bool) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
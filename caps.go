@@ -0,0 +1,72 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+// Capabilities summarizes what a device supports, as described by the
+// constraints of its options. Fields are empty if the device has no
+// corresponding option or does not constrain it.
+type Capabilities struct {
+	Modes       []string  // scan modes
+	Sources     []string  // scan sources
+	Resolutions []float64 // supported resolutions in DPI, if listed
+	MinDPI      float64   // lowest resolution in DPI
+	MaxDPI      float64   // highest resolution in DPI
+	MaxArea     Rect      // largest scan area in millimeters
+}
+
+// constrStrings returns the string list constraint of the named option.
+func (c *Conn) constrStrings(name string) []string {
+	o := findOpt(c.Options(), name)
+	if o == nil || o.Type != TypeString {
+		return nil
+	}
+	var l []string
+	for _, v := range o.ConstrSet {
+		l = append(l, v.(string))
+	}
+	return l
+}
+
+// constrBounds returns the smallest and largest values allowed by the
+// constraint of the named numeric option, and the allowed values if they are
+// listed. All are zero if the option is not constrained.
+func (c *Conn) constrBounds(name string) (min, max float64, list []float64) {
+	o := findOpt(c.Options(), name)
+	if o == nil || (o.Type != TypeInt && o.Type != TypeFloat) {
+		return 0, 0, nil
+	}
+	if r := o.ConstrRange; r != nil {
+		return toFloat(r.Min), toFloat(r.Max), nil
+	}
+	for i, v := range o.ConstrSet {
+		f := toFloat(v)
+		if i == 0 || f < min {
+			min = f
+		}
+		if i == 0 || f > max {
+			max = f
+		}
+		list = append(list, f)
+	}
+	return min, max, list
+}
+
+// Capabilities returns a summary of the device capabilities.
+func (c *Conn) Capabilities() Capabilities {
+	caps := Capabilities{Modes: c.constrStrings("mode")}
+	if srcs, err := c.Sources(); err == nil {
+		caps.Sources = srcs
+	}
+	if names, err := c.resolutionOpts(); err == nil {
+		caps.MinDPI, caps.MaxDPI, caps.Resolutions = c.constrBounds(names[0])
+	}
+	if o := findOpt(c.Options(), "br-x"); o != nil && o.Unit == UnitMm {
+		_, caps.MaxArea.Right, _ = c.constrBounds("br-x")
+	}
+	if o := findOpt(c.Options(), "br-y"); o != nil && o.Unit == UnitMm {
+		_, caps.MaxArea.Bottom, _ = c.constrBounds("br-y")
+	}
+	return caps
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+// ApplyColorMatrix returns a copy of the image with each pixel's RGB samples,
+// as a column vector, multiplied by mat. Results are rounded and clamped to
+// the range of the image's depth. Gray images are returned unchanged, as a
+// copy.
+func (m *Image) ApplyColorMatrix(mat [3][3]float64) *Image {
+	n := m.mapFrames(func(f *Frame) *Frame {
+		g := newFrame(f, f.Width, f.Height)
+		copyRect(g, image.Point{}, f, image.Rect(0, 0, f.Width, f.Height))
+		return g
+	})
+	if m.channels() == 1 {
+		return n
+	}
+	max := float64(m.maxSample())
+	w, h := m.fs[0].Width, m.fs[0].Height
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var s [3]float64
+			for i := range s {
+				s[i] = float64(m.sampleAt(x, y, i))
+			}
+			for i, row := range mat {
+				v := row[0]*s[0] + row[1]*s[1] + row[2]*s[2] + 0.5
+				switch {
+				case v < 0:
+					v = 0
+				case v > max:
+					v = max
+				}
+				n.setSample(x, y, i, uint16(v))
+			}
+		}
+	}
+	return n
+}
+
+// Swap returns a copy of the image with its color channels reordered: the
+// channels of the returned image are the channels of m named by order, which
+// must be a permutation of "RGB", such as "BGR". Gray images are returned
+// unchanged, as a copy.
+func (m *Image) Swap(order string) (*Image, error) {
+	var src [3]int
+	if len(order) != 3 {
+		return nil, fmt.Errorf("invalid channel order %q", order)
+	}
+	seen := 0
+	for i := range src {
+		src[i] = strings.IndexByte("RGB", order[i])
+		if src[i] < 0 || seen&(1<<uint(src[i])) != 0 {
+			return nil, fmt.Errorf("invalid channel order %q", order)
+		}
+		seen |= 1 << uint(src[i])
+	}
+	if m.fs[0].Format != FrameRgb {
+		if m.fs[0].Format == FrameGray {
+			return m.SubImage(m.Bounds()), nil
+		}
+		// Reorder planar frames, keeping their formats in RGB order.
+		n := m.SubImage(m.Bounds())
+		fs := n.fs
+		for i := range n.fs {
+			n.fs[i] = fs[src[i]]
+			n.fs[i].Format = FrameRed + Format(i)
+		}
+		return n, nil
+	}
+	f := m.fs[0]
+	g := newFrame(f, f.Width, f.Height)
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			for i := range src {
+				g.set(x, y, i, f.AtUnchecked(x, y, src[i]))
+			}
+		}
+	}
+	return &Image{Side: m.Side, fs: [3]*Frame{g}, bg: m.bg}, nil
+}
@@ -0,0 +1,237 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// to16 scales a sample of the given depth to 16 bits.
+func to16(v uint16, depth int) uint16 {
+	switch depth {
+	case 1:
+		return 0xffff * v
+	case 8:
+		return 0x101 * v
+	}
+	return v
+}
+
+// rgb16At returns the color of the pixel at (x,y) with 16-bit components.
+func (m *Image) rgb16At(x, y int) (r, g, b uint16) {
+	d := m.fs[0].Depth
+	if m.fs[0].Format == FrameGray {
+		v := to16(m.sampleAt(x, y, 0), d)
+		return v, v, v
+	}
+	return to16(m.sampleAt(x, y, 0), d),
+		to16(m.sampleAt(x, y, 1), d),
+		to16(m.sampleAt(x, y, 2), d)
+}
+
+// MaxSample returns the largest sample value for the depth of the image: 1,
+// 255 or 65535.
+func (m *Image) MaxSample() uint32 {
+	return uint32(m.maxSample())
+}
+
+// NormalizedAt is like At, but scales samples of any depth to the full 16-bit
+// range, returning a color.Gray16 for gray images and a color.RGBA64 for color
+// images. Pixels outside the bounds have the background color.
+func (m *Image) NormalizedAt(x, y int) color.Color {
+	if !(image.Point{x, y}.In(m.Bounds())) {
+		return m.At(x, y)
+	}
+	r, g, b := m.rgb16At(x, y)
+	if m.fs[0].Format == FrameGray {
+		return color.Gray16{r}
+	}
+	return color.RGBA64{r, g, b, opaque16}
+}
+
+// luma16 returns the luminance of a color, as computed by color.Gray16Model.
+func luma16(r, g, b uint16) uint16 {
+	return uint16((19595*uint32(r) + 38470*uint32(g) + 7471*uint32(b) + 1<<15) >> 16)
+}
+
+// ToRGBA converts the image to an *image.RGBA in a single pass.
+// Samples deeper than 8 bits are truncated.
+func (m *Image) ToRGBA() *image.RGBA {
+	dst := image.NewRGBA(m.Bounds())
+	m.drawRGBA(dst)
+	return dst
+}
+
+// drawRGBA converts the image into dst, which must have the same size, with
+// the origin of the image at dst.Rect.Min.
+func (m *Image) drawRGBA(dst *image.RGBA) {
+	b, o := m.Bounds(), dst.Rect.Min
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r, g, bl := m.rgb16At(x, y)
+			i := dst.PixOffset(o.X+x, o.Y+y)
+			dst.Pix[i+0] = uint8(r >> 8)
+			dst.Pix[i+1] = uint8(g >> 8)
+			dst.Pix[i+2] = uint8(bl >> 8)
+			dst.Pix[i+3] = opaque8
+		}
+	}
+}
+
+// ToNRGBA64 converts the image to an *image.NRGBA64 in a single pass.
+// The conversion is lossless.
+func (m *Image) ToNRGBA64() *image.NRGBA64 {
+	b := m.Bounds()
+	dst := image.NewNRGBA64(b)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r, g, bl := m.rgb16At(x, y)
+			dst.SetNRGBA64(x, y, color.NRGBA64{r, g, bl, opaque16})
+		}
+	}
+	return dst
+}
+
+// ToGray converts the image to an *image.Gray in a single pass.
+// Color images are converted to luminance and samples deeper than 8 bits
+// are truncated.
+func (m *Image) ToGray() *image.Gray {
+	b := m.Bounds()
+	dst := image.NewGray(b)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dst.Pix[dst.PixOffset(x, y)] = uint8(luma16(m.rgb16At(x, y)) >> 8)
+		}
+	}
+	return dst
+}
+
+// ToGray16 converts the image to an *image.Gray16 in a single pass.
+// Color images are converted to luminance.
+func (m *Image) ToGray16() *image.Gray16 {
+	b := m.Bounds()
+	dst := image.NewGray16(b)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dst.SetGray16(x, y, color.Gray16{luma16(m.rgb16At(x, y))})
+		}
+	}
+	return dst
+}
+
+// Gray16Bytes returns the samples of a 16-bit gray image as unpadded lines
+// of 2-byte big-endian values, the layout used by image.Gray16 and by the PNG
+// encoder. Samples are decoded as by Frame.At, which takes the 16-bit samples
+// delivered by SANE to be little-endian. It returns nil for other images.
+func (m *Image) Gray16Bytes() []byte {
+	f := m.fs[0]
+	if f.Format != FrameGray || f.Depth != 16 {
+		return nil
+	}
+	buf := make([]byte, 0, 2*f.Width*f.Height)
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			v := f.AtUnchecked(x, y, 0)
+			buf = append(buf, uint8(v>>8), uint8(v))
+		}
+	}
+	return buf
+}
+
+// RGB48Bytes returns the samples of a 16-bit color image as unpadded lines of
+// interleaved red, green and blue 2-byte big-endian values, whether or not the
+// image was scanned in three passes. Byte order is as in Gray16Bytes. It
+// returns nil for other images.
+func (m *Image) RGB48Bytes() []byte {
+	f := m.fs[0]
+	if f.Format == FrameGray || f.Depth != 16 {
+		return nil
+	}
+	buf := make([]byte, 0, 6*f.Width*f.Height)
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			for i := 0; i < 3; i++ {
+				v := m.sampleAt(x, y, i)
+				buf = append(buf, uint8(v>>8), uint8(v))
+			}
+		}
+	}
+	return buf
+}
+
+// StdImage converts the image to the standard library image type that holds
+// it losslessly: *image.Gray, *image.Gray16, *image.RGBA or *image.NRGBA64.
+// Encoders such as png.Encode copy these types in bulk, which is much faster
+// than calling At for every pixel.
+func (m *Image) StdImage() image.Image {
+	f := m.fs[0]
+	switch {
+	case f.Format == FrameGray && f.Depth == 16:
+		return m.ToGray16()
+	case f.Format == FrameGray:
+		return m.ToGray()
+	case f.Depth == 16:
+		return m.ToNRGBA64()
+	}
+	return m.ToRGBA()
+}
+
+// scratchPool is the buffer pool ReadImageInto uses when none is set with
+// SetBufferPool. It keeps the frame buffers of one scan for the next.
+type scratchPool struct {
+	bufs [][]byte
+}
+
+func (p *scratchPool) Get(n int) []byte {
+	for i, b := range p.bufs {
+		if cap(b) >= n {
+			p.bufs = append(p.bufs[:i], p.bufs[i+1:]...)
+			return b[:n]
+		}
+	}
+	return make([]byte, n)
+}
+
+func (p *scratchPool) Put(b []byte) {
+	if len(p.bufs) < 3 { // enough for the frames of one image
+		p.bufs = append(p.bufs, b)
+	}
+}
+
+// ReadImageInto reads an image from the connection into dst, as converted by
+// ToRGBA, to save allocating a new image for each scan. The frame data is
+// read into buffers taken from the buffer pool, or kept by the connection
+// from one call to the next if none is set, and released once drawn. It
+// fails without scanning if the size of dst does not match the scan
+// parameters, or after scanning if it does not match the size of the scanned
+// image, which may not be known in advance.
+func (c *Conn) ReadImageInto(dst *image.RGBA) error {
+	p, err := c.Params()
+	if err != nil {
+		return err
+	}
+	w, h := dst.Rect.Dx(), dst.Rect.Dy()
+	if p.PixelsPerLine != w || (p.Lines >= 0 && p.Lines != h) {
+		return fmt.Errorf("image size %dx%d does not match scan size %dx%d",
+			w, h, p.PixelsPerLine, p.Lines)
+	}
+	if c.pool == nil {
+		c.pool = &c.scratch
+		defer func() { c.pool = nil }()
+	}
+	m, err := c.ReadImage()
+	if err != nil {
+		return err
+	}
+	defer m.Release()
+	if b := m.Bounds(); b.Dx() != w || b.Dy() != h {
+		return fmt.Errorf("image size %dx%d does not match scanned size %dx%d",
+			w, h, b.Dx(), b.Dy())
+	}
+	m.drawRGBA(dst)
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import "sort"
+
+// activeSet returns the names of the active options.
+func (c *Conn) activeSet() map[string]bool {
+	m := make(map[string]bool)
+	for _, o := range c.Options() {
+		if o.IsActive {
+			m[o.Name] = true
+		}
+	}
+	return m
+}
+
+// probeValues returns the values other than the current one that o can be
+// set to when probing dependencies, or nil if o is not worth probing.
+func (c *Conn) probeValues(o Option) []interface{} {
+	if !o.IsActive || !o.IsSettable {
+		return nil
+	}
+	cur, err := c.GetOption(o.Name)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case o.Type == TypeBool && o.Length == 1:
+		return []interface{}{!cur.(bool)}
+	case o.Type == TypeString && len(o.ConstrSet) > 0:
+		var vals []interface{}
+		for _, v := range o.ConstrSet {
+			if v != cur {
+				vals = append(vals, v)
+			}
+		}
+		return vals
+	}
+	return nil
+}
+
+// OptionDependencies returns, for each option whose value affects which other
+// options are active, the names of those options in order. It finds them by
+// setting each boolean and string list option to each of its other values in
+// turn, so it may be slow, and restores all options afterwards. Only options
+// active with the current settings are probed.
+//
+// The result is cached until InvalidateOptions is called or setting an option
+// reloads the others, and must not be modified.
+func (c *Conn) OptionDependencies() (map[string][]string, error) {
+	if c.deps != nil {
+		return c.deps, nil
+	}
+	hook := c.changeHook
+	c.changeHook = nil // probing changes are not for the caller
+	defer func() { c.changeHook = hook }()
+	saved := c.snapshot()
+	deps := make(map[string][]string)
+	for _, o := range append([]Option(nil), c.Options()...) {
+		vals := c.probeValues(o)
+		if vals == nil {
+			continue
+		}
+		cur, _ := c.GetOption(o.Name)
+		before := c.activeSet()
+		affected := make(map[string]bool)
+		for _, v := range vals {
+			if _, err := c.SetOption(o.Name, v); err != nil {
+				continue
+			}
+			after := c.activeSet()
+			for name := range before {
+				affected[name] = affected[name] || !after[name]
+			}
+			for name := range after {
+				affected[name] = affected[name] || !before[name]
+			}
+			if _, err := c.SetOption(o.Name, cur); err != nil {
+				c.restore(saved)
+				return nil, err
+			}
+		}
+		for name, ok := range affected {
+			if ok && name != o.Name {
+				deps[o.Name] = append(deps[o.Name], name)
+			}
+		}
+		sort.Strings(deps[o.Name])
+	}
+	if err := c.restore(saved); err != nil {
+		return nil, err
+	}
+	c.deps = deps
+	return deps, nil
+}
@@ -3,6 +3,10 @@
 // The package exposes all of the SANE primitives. It also provides a somewhat
 // higher-level interface for scanning one or more images, described below.
 //
+// The bindings use cgo and libsane, and are only built with the sane_cgo build
+// tag. Without it, the package can still process images, but Init, Open and
+// the other device functions fail with ErrUnsupported.
+//
 // Before anything else, you must call Init to initialize the library.
 //
 //   err := sane.Init()
@@ -39,6 +43,10 @@
 //
 //   c.Close()
 //
+// A connection must not be used by several goroutines at once, except for
+// Cancel, but connections to different devices are independent and may
+// scan concurrently.
+//
 // Finally, when you are done with the library, call Exit.
 //
 //   sane.Exit()
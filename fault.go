@@ -0,0 +1,16 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+// InjectReadError makes subsequent reads fail with the given SANE status,
+// such as "SANE_STATUS_JAMMED", for testing error handling. The status
+// "Default" restores normal operation. It only works on connections to the
+// SANE test backend, and returns ErrUnsupported for other devices.
+func (c *Conn) InjectReadError(status string) error {
+	if (Device{Name: c.Device}).Backend() != "test" {
+		return ErrUnsupported
+	}
+	return c.setListed("read-return-value", status)
+}
@@ -5,24 +5,131 @@
 package sane
 
 import (
-	"bytes"
 	"fmt"
+	"image"
+	"io"
+	"time"
+)
+
+// defaultReadLines is the number of lines read at once by default.
+const defaultReadLines = 32
+
+// Bounds of the delay between reads that return no data, as in non-blocking
+// mode, so that waiting for data does not spin.
+const (
+	minReadWait = time.Millisecond
+	maxReadWait = 50 * time.Millisecond
 )
 
 // A Frame represents one or more channels in an image.
+//
+// The raw data returned by Data holds Height lines of BytesPerLine bytes.
+// Each line holds the samples for Width pixels followed by Pad bytes of
+// padding. At accounts for the padding.
 type Frame struct {
-	Format       Format // frame format
-	Width        int    // width in pixels
-	Height       int    // height in pixels
-	Channels     int    // number of channels
-	Depth        int    // bits per sample
-	IsLast       bool   // whether this is the last frame
-	bytesPerLine int    // bytes per line, including any padding
-	data         []byte // raw data
+	Format       Format     // frame format
+	Width        int        // width in pixels
+	Height       int        // height in pixels
+	Channels     int        // number of channels
+	Depth        int        // bits per sample
+	IsLast       bool       // whether this is the last frame
+	BytesPerLine int        // bytes per line, including any padding
+	Pad          int        // padding bytes at the end of each line
+	data         []byte     // raw data
+	pool         BufferPool // pool data was taken from, if any
+}
+
+// lineBytes returns the number of bytes needed to hold a line of w pixels
+// with nch channels of the given depth, excluding padding. Samples deeper
+// than 8 bits take two bytes.
+func lineBytes(w, nch, depth int) int {
+	switch {
+	case depth == 1:
+		return nch * ((w + 7) / 8)
+	case depth > 8:
+		return nch * w * 2
+	}
+	return nch * w * depth / 8
+}
+
+// supportedDepth reports whether frames of the given depth can be read.
+func supportedDepth(depth int) bool {
+	return depth == 1 || depth == 8 || (depth > 8 && depth <= 16)
 }
 
-// ReadFrame reads and returns a whole frame.
+// widen scales samples of a depth between 9 and 15 bits, held in two bytes
+// each, to 16 bits, so that the full 16-bit range is used. It sets the depth
+// of the frame to 16.
+func (f *Frame) widen() {
+	d := uint(f.Depth)
+	n := lineBytes(f.Width, f.Channels, f.Depth)
+	for y := 0; y < f.Height; y++ {
+		line := f.data[y*f.BytesPerLine : y*f.BytesPerLine+n]
+		for i := 0; i+1 < len(line); i += 2 {
+			v := uint16(line[i+1])<<8 | uint16(line[i])
+			v = v<<(16-d) | v>>(2*d-16) // replicate the top bits
+			line[i], line[i+1] = uint8(v), uint8(v>>8)
+		}
+	}
+	f.Depth = 16
+}
+
+// Data returns the raw frame data. It is not a copy, so it must not be
+// modified.
+func (f *Frame) Data() []byte {
+	return f.data
+}
+
+// BytesPerSample returns the number of bytes taken by each sample in the
+// frame data. It is 0 for 1-bit frames, which pack eight samples per byte.
+// The number of samples per pixel is given by Channels.
+func (f *Frame) BytesPerSample() int {
+	return f.Depth / 8
+}
+
+// ReadFrame reads and returns a whole frame. Once the last frame of an image
+// has been read, it fails with ErrLastFrame until Cancel is called.
+//
+// Frames of depths other than 1, 8 and 16 bits are rejected, except that
+// those of 9 to 15 bits, as reported by some film scanners, are scaled to 16
+// bits.
 func (c *Conn) ReadFrame() (*Frame, error) {
+	if c.isDone() {
+		return nil, ErrLastFrame
+	}
+	return c.readFrame()
+}
+
+// MoreFrames reports whether ReadFrame is expected to return another frame of
+// the current image. It becomes false once the last frame has been read, and
+// true again after Cancel, so frames can be read in a loop:
+//
+//	for c.MoreFrames() {
+//		f, err := c.ReadFrame()
+//		...
+//	}
+func (c *Conn) MoreFrames() bool {
+	return !c.isDone()
+}
+
+// isDone reports whether the last frame of the current image was read.
+func (c *Conn) isDone() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done
+}
+
+func (c *Conn) readFrame() (*Frame, error) {
+	f, err := c.readRawFrame()
+	if err == nil && f.Depth > 8 && f.Depth < 16 {
+		f.widen()
+	}
+	return f, err
+}
+
+// readRawFrame is like readFrame, but leaves samples of 9 to 15 bits as the
+// device sent them.
+func (c *Conn) readRawFrame() (*Frame, error) {
 	if err := c.Start(); err != nil {
 		return nil, err
 	}
@@ -32,18 +139,62 @@ func (c *Conn) ReadFrame() (*Frame, error) {
 		return nil, err
 	}
 
-	if p.Depth != 1 && p.Depth != 8 && p.Depth != 16 {
+	if !supportedDepth(p.Depth) {
 		return nil, fmt.Errorf("unsupported bit depth: %d", p.Depth)
 	}
 
-	data := new(bytes.Buffer)
+	n := c.bufSize
+	if n <= 0 {
+		n = defaultReadLines * p.BytesPerLine
+	}
+	var data []byte
 	if p.Lines > 0 {
 		// Preallocate buffer with expected size
-		data = bytes.NewBuffer(make([]byte, 0, p.Lines*p.BytesPerLine))
+		data = c.alloc(p.Lines * p.BytesPerLine)
+	} else {
+		data = c.alloc(n)
 	}
-
-	if _, err := data.ReadFrom(c); err != nil {
-		return nil, err
+	// Once the buffer is full, data is read into spare, and the buffer only
+	// grows if more arrives, so that a buffer of the expected size is kept.
+	var spare []byte
+	wait := minReadWait
+	// sane_read never returns data from more than one frame, and the next
+	// frame is only started by the next call, after this one reached EOF.
+	for {
+		var k int
+		if room := cap(data) - len(data); room > 0 {
+			if room > n {
+				room = n
+			}
+			k, err = c.Read(data[len(data) : len(data)+room])
+			data = data[:len(data)+k]
+		} else {
+			if spare == nil {
+				spare = make([]byte, n)
+			}
+			k, err = c.Read(spare)
+			if k > 0 {
+				d := c.alloc(2*cap(data) + n)[:len(data)]
+				copy(d, data)
+				c.free(data)
+				data = append(d, spare[:k]...)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.free(data)
+			return nil, err
+		}
+		if k > 0 {
+			wait = minReadWait
+			continue
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > maxReadWait {
+			wait = maxReadWait
+		}
 	}
 
 	nch := 1
@@ -51,24 +202,83 @@ func (c *Conn) ReadFrame() (*Frame, error) {
 		nch = 3
 	}
 
-	return &Frame{
+	// p.Lines is unreliable, and -1 for hand scanners; count the lines read
+	// instead, dropping any incomplete last line.
+	h := len(data) / p.BytesPerLine
+	data = data[:h*p.BytesPerLine]
+
+	c.mu.Lock()
+	c.done = p.IsLast
+	c.mu.Unlock()
+	f := &Frame{
 		Format:       p.Format,
 		Width:        p.PixelsPerLine,
-		Height:       data.Len() / p.BytesPerLine, // p.Lines is unreliable
+		Height:       h,
 		Channels:     nch,
 		Depth:        p.Depth,
 		IsLast:       p.IsLast,
-		bytesPerLine: p.BytesPerLine,
-		data:         data.Bytes()}, nil
+		BytesPerLine: p.BytesPerLine,
+		Pad:          p.BytesPerLine - lineBytes(p.PixelsPerLine, nch, p.Depth),
+		data:         data,
+		pool:         c.pool}
+	return f, nil
+}
+
+// alloc returns an empty buffer with a capacity of at least n bytes, taken
+// from the buffer pool if there is one.
+func (c *Conn) alloc(n int) []byte {
+	if c.pool != nil {
+		return c.pool.Get(n)[:0]
+	}
+	return make([]byte, 0, n)
+}
+
+// free returns a buffer obtained from alloc to the buffer pool, if any.
+func (c *Conn) free(b []byte) {
+	if c.pool != nil && b != nil {
+		c.pool.Put(b)
+	}
+}
+
+// Release returns the frame data to the buffer pool it was taken from, as set
+// by SetBufferPool. The frame must not be used afterwards. Release does
+// nothing for frames not taken from a pool.
+func (f *Frame) Release() {
+	if f.pool != nil {
+		f.pool.Put(f.data)
+	}
+	f.data = nil
+	f.pool = nil
+}
+
+// Clone returns a copy of f with its own copy of the frame data, which is
+// not taken from any buffer pool.
+func (f *Frame) Clone() *Frame {
+	g := *f
+	g.data = append([]byte(nil), f.data...)
+	g.pool = nil
+	return &g
 }
 
 // At returns the sample at coordinates (x,y) for channel ch.
 // Note that values are not normalized to the uint16 range,
 // so you need to interpret them relative to the color depth.
+// It returns 0 if the coordinates or the channel are out of range.
 func (f *Frame) At(x, y, ch int) uint16 {
+	if x < 0 || x >= f.Width || y < 0 || y >= f.Height || ch < 0 || ch >= f.Channels {
+		return 0
+	}
+	return f.AtUnchecked(x, y, ch)
+}
+
+// AtUnchecked is like At, but does not check its arguments, for use in loops
+// that have already done so. The coordinates must lie within the frame and
+// the channel must be less than Channels; otherwise AtUnchecked may return
+// samples from the line padding or from other pixels, or panic.
+func (f *Frame) AtUnchecked(x, y, ch int) uint16 {
 	switch f.Depth {
 	case 1:
-		i := f.bytesPerLine*y + f.Channels*(x/8) + ch
+		i := f.BytesPerLine*y + f.Channels*(x/8) + ch
 		s := (f.data[i] >> uint8(x%8)) & 0x01
 		if f.Format == FrameGray {
 			// For B&W lineart, 0 is white and 1 is black
@@ -76,11 +286,86 @@ func (f *Frame) At(x, y, ch int) uint16 {
 		}
 		return uint16(s)
 	case 8:
-		i := f.bytesPerLine*y + f.Channels*x + ch
+		i := f.BytesPerLine*y + f.Channels*x + ch
 		return uint16(f.data[i])
 	case 16:
-		i := f.bytesPerLine*y + 2*(f.Channels*x+ch)
+		i := f.BytesPerLine*y + 2*(f.Channels*x+ch)
 		return uint16(f.data[i+1])<<8 + uint16(f.data[i])
 	}
 	return 0
 }
+
+// newFrame returns a blank frame with the same format as f and the given
+// dimensions.
+func newFrame(f *Frame, w, h int) *Frame {
+	g := makeFrame(f.Format, w, h, f.Depth)
+	g.IsLast = f.IsLast
+	return g
+}
+
+// makeFrame returns a blank, unpadded frame with the given properties.
+func makeFrame(format Format, w, h, depth int) *Frame {
+	nch := 1
+	if format == FrameRgb {
+		nch = 3
+	}
+	bpl := lineBytes(w, nch, depth)
+	return &Frame{
+		Format:       format,
+		Width:        w,
+		Height:       h,
+		Channels:     nch,
+		Depth:        depth,
+		IsLast:       true,
+		BytesPerLine: bpl,
+		data:         make([]byte, h*bpl)}
+}
+
+// set sets the sample at coordinates (x,y) for channel ch.
+// It is the inverse of AtUnchecked.
+func (f *Frame) set(x, y, ch int, v uint16) {
+	switch f.Depth {
+	case 1:
+		i := f.BytesPerLine*y + f.Channels*(x/8) + ch
+		if f.Format == FrameGray {
+			v ^= 0x1 // see At
+		}
+		mask := uint8(0x01) << uint8(x%8)
+		if v&0x1 != 0 {
+			f.data[i] |= mask
+		} else {
+			f.data[i] &^= mask
+		}
+	case 8:
+		i := f.BytesPerLine*y + f.Channels*x + ch
+		f.data[i] = uint8(v)
+	case 16:
+		i := f.BytesPerLine*y + 2*(f.Channels*x+ch)
+		f.data[i] = uint8(v)
+		f.data[i+1] = uint8(v >> 8)
+	}
+}
+
+// copyRect copies the samples of src within r to dst, placing r.Min at dp.
+// The frames must have the same format and r must lie within both frames.
+func copyRect(dst *Frame, dp image.Point, src *Frame, r image.Rectangle) {
+	w, h := r.Dx(), r.Dy()
+	if src.Depth == 1 {
+		// Samples are not byte-aligned; copy them one by one.
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				for ch := 0; ch < src.Channels; ch++ {
+					v := src.AtUnchecked(r.Min.X+x, r.Min.Y+y, ch)
+					dst.set(dp.X+x, dp.Y+y, ch, v)
+				}
+			}
+		}
+		return
+	}
+	bpp := src.Channels * src.BytesPerSample()
+	for y := 0; y < h; y++ {
+		i := src.BytesPerLine*(r.Min.Y+y) + bpp*r.Min.X
+		j := dst.BytesPerLine*(dp.Y+y) + bpp*dp.X
+		copy(dst.data[j:j+bpp*w], src.data[i:i+bpp*w])
+	}
+}
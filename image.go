@@ -5,9 +5,11 @@
 package sane
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"image/color"
+	"sync"
 )
 
 var (
@@ -19,7 +21,15 @@ var (
 //
 // It implements the image.Image interface.
 type Image struct {
-	fs [3]*Frame // multiple frames must be in RGB order
+	Side Side        // side of the sheet, for images read from a feeder
+	fs   [3]*Frame   // multiple frames must be in RGB order
+	bg   color.Color // color outside the bounds, nil for white
+}
+
+// SetBackground sets the color returned by At for pixels outside the image
+// bounds. The default is opaque white, the color of the paper.
+func (m *Image) SetBackground(c color.Color) {
+	m.bg = c
 }
 
 // Bounds returns the domain for which At returns valid pixels.
@@ -44,35 +54,44 @@ func (m *Image) ColorModel() color.Model {
 	return color.RGBAModel
 }
 
+// Format returns the format of the image: FrameGray for gray images and
+// FrameRgb for color images, whether or not they were scanned in three passes.
+func (m *Image) Format() Format {
+	if m.fs[0].Format == FrameGray {
+		return FrameGray
+	}
+	return FrameRgb
+}
+
+// Planar reports whether the image is made up of separate red, green and
+// blue frames, as in three-pass scans, rather than a single frame.
+func (m *Image) Planar() bool {
+	return m.fs[0].Format == FrameRed
+}
+
 // At returns the color of the pixel at (x, y).
 func (m *Image) At(x, y int) color.Color {
 	if x < 0 || x >= m.fs[0].Width || y < 0 || y >= m.fs[0].Height {
-		return color.RGBA{}
+		if m.bg == nil {
+			return color.White
+		}
+		return m.bg
 	}
 	if m.fs[0].Format == FrameGray {
 		// grayscale
 		switch m.fs[0].Depth {
 		case 1:
-			return color.Gray{uint8(0xFF * m.fs[0].At(x, y, 0))}
+			return color.Gray{uint8(0xFF * m.fs[0].AtUnchecked(x, y, 0))}
 		case 8:
-			return color.Gray{uint8(m.fs[0].At(x, y, 0))}
+			return color.Gray{uint8(m.fs[0].AtUnchecked(x, y, 0))}
 		case 16:
-			return color.Gray16{m.fs[0].At(x, y, 0)}
+			return color.Gray16{m.fs[0].AtUnchecked(x, y, 0)}
 		}
 	} else {
 		// color
-		var r, g, b uint16
-		if m.fs[0].Format == FrameRgb {
-			// interleaved
-			r = m.fs[0].At(x, y, 0)
-			g = m.fs[0].At(x, y, 1)
-			b = m.fs[0].At(x, y, 2)
-		} else {
-			// non-interleaved
-			r = m.fs[0].At(x, y, 0)
-			g = m.fs[1].At(x, y, 0)
-			b = m.fs[2].At(x, y, 0)
-		}
+		r := m.sampleAt(x, y, 0)
+		g := m.sampleAt(x, y, 1)
+		b := m.sampleAt(x, y, 2)
 		switch m.fs[0].Depth {
 		case 1:
 			return color.RGBA{uint8(0xFF * r), uint8(0xFF * g), uint8(0xFF * b), opaque8}
@@ -85,48 +104,305 @@ func (m *Image) At(x, y int) color.Color {
 	return color.RGBA{} // shouldn't happen
 }
 
+// Row fills dst with the colors of the pixels in line y, as returned by At,
+// and returns the number of pixels filled, which is the smaller of len(dst)
+// and the image width. It returns 0 if y is out of bounds. Row is faster than
+// calling At for each pixel, as the bounds and format are checked once.
+func (m *Image) Row(y int, dst []color.Color) int {
+	f := m.fs[0]
+	if y < 0 || y >= f.Height {
+		return 0
+	}
+	n := f.Width
+	if len(dst) < n {
+		n = len(dst)
+	}
+	dst = dst[:n]
+	switch {
+	case f.Format == FrameGray && f.Depth == 1:
+		for x := range dst {
+			dst[x] = color.Gray{uint8(0xFF * f.AtUnchecked(x, y, 0))}
+		}
+	case f.Format == FrameGray && f.Depth == 8:
+		for x := range dst {
+			dst[x] = color.Gray{uint8(f.AtUnchecked(x, y, 0))}
+		}
+	case f.Format == FrameGray:
+		for x := range dst {
+			dst[x] = color.Gray16{f.AtUnchecked(x, y, 0)}
+		}
+	case f.Depth == 16:
+		for x := range dst {
+			dst[x] = color.RGBA64{m.sampleAt(x, y, 0), m.sampleAt(x, y, 1),
+				m.sampleAt(x, y, 2), opaque16}
+		}
+	default:
+		d := f.Depth
+		for x := range dst {
+			dst[x] = color.RGBA{to8(m.sampleAt(x, y, 0), d), to8(m.sampleAt(x, y, 1), d),
+				to8(m.sampleAt(x, y, 2), d), opaque8}
+		}
+	}
+	return n
+}
+
+// sampleAt returns the sample at (x,y) for channel i of the image.
+// Color channels are in RGB order; gray images have a single channel.
+func (m *Image) sampleAt(x, y, i int) uint16 {
+	if m.fs[0].Format == FrameRgb {
+		// interleaved
+		return m.fs[0].AtUnchecked(x, y, i)
+	}
+	// gray or non-interleaved
+	return m.fs[i].AtUnchecked(x, y, 0)
+}
+
+// setSample sets the sample at (x,y) for channel i of the image.
+// It is the inverse of sampleAt.
+func (m *Image) setSample(x, y, i int, v uint16) {
+	if m.fs[0].Format == FrameRgb {
+		m.fs[0].set(x, y, i, v)
+		return
+	}
+	m.fs[i].set(x, y, 0, v)
+}
+
+// to8 scales a sample of the given depth to 8 bits.
+func to8(v uint16, depth int) uint8 {
+	switch depth {
+	case 1:
+		return uint8(0xFF * v)
+	case 16:
+		return uint8(v >> 8)
+	}
+	return uint8(v)
+}
+
+// PlanarRGB returns the red, green and blue channels of the image as separate
+// 8-bit planes, with stride bytes per line. For gray images, the three planes
+// are identical.
+func (m *Image) PlanarRGB() (r, g, b []byte, stride int) {
+	f := m.fs[0]
+	stride = f.Width
+	var planes [3][]byte
+	for i := range planes {
+		if f.Format == FrameGray && i > 0 {
+			planes[i] = planes[0]
+			continue
+		}
+		p := make([]byte, stride*f.Height)
+		for y := 0; y < f.Height; y++ {
+			for x := 0; x < f.Width; x++ {
+				p[stride*y+x] = to8(m.sampleAt(x, y, i), f.Depth)
+			}
+		}
+		planes[i] = p
+	}
+	return planes[0], planes[1], planes[2], stride
+}
+
+// mapFrames returns a new image whose frames are the result of applying fn
+// to each frame of m.
+func (m *Image) mapFrames(fn func(f *Frame) *Frame) *Image {
+	n := Image{Side: m.Side, bg: m.bg}
+	for i, f := range m.fs {
+		if f != nil {
+			n.fs[i] = fn(f)
+		}
+	}
+	return &n
+}
+
+// SubImage returns a copy of the portion of the image visible through r,
+// which is clipped to the image bounds. The bounds of the returned image
+// start at the origin.
+func (m *Image) SubImage(r image.Rectangle) *Image {
+	r = r.Intersect(m.Bounds())
+	return m.mapFrames(func(f *Frame) *Frame {
+		g := newFrame(f, r.Dx(), r.Dy())
+		copyRect(g, image.Point{}, f, r)
+		return g
+	})
+}
+
+// samples returns the per-channel samples that best represent c
+// in the image's color model, in RGB order for color images.
+func (m *Image) samples(c color.Color) (s [3]uint16) {
+	f := m.fs[0]
+	if f.Format == FrameGray {
+		y := color.Gray16Model.Convert(c).(color.Gray16).Y
+		s = [3]uint16{y, y, y}
+	} else {
+		r, g, b, _ := c.RGBA()
+		s = [3]uint16{uint16(r), uint16(g), uint16(b)}
+	}
+	for i := range s {
+		s[i] >>= uint(16 - f.Depth)
+	}
+	return
+}
+
+// WithMargin returns a copy of the image centered on a background of color
+// bg, with a margin of px pixels on all sides. A negative px is treated as 0.
+func (m *Image) WithMargin(px int, bg color.Color) *Image {
+	if px < 0 {
+		px = 0
+	}
+	s := m.samples(bg)
+	n := Image{Side: m.Side, bg: m.bg}
+	for i, f := range m.fs {
+		if f == nil {
+			continue
+		}
+		g := newFrame(f, f.Width+2*px, f.Height+2*px)
+		for y := 0; y < g.Height; y++ {
+			for x := 0; x < g.Width; x++ {
+				for ch := 0; ch < g.Channels; ch++ {
+					g.set(x, y, ch, s[i+ch]) // planar frames have one channel
+				}
+			}
+		}
+		copyRect(g, image.Pt(px, px), f, image.Rect(0, 0, f.Width, f.Height))
+		n.fs[i] = g
+	}
+	return &n
+}
+
+// plane returns the index in Image.fs of frames with format f.
+func plane(f Format) (int, error) {
+	switch f {
+	case FrameGray, FrameRgb, FrameRed:
+		return 0, nil
+	case FrameGreen:
+		return 1, nil
+	case FrameBlue:
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unknown frame type %d", f)
+}
+
+// checkFrames checks that m holds either a single gray or RGB frame,
+// or a complete set of red, green and blue frames of equal size.
+func (m *Image) checkFrames() error {
+	f := m.fs[0]
+	if f == nil || f.Format == FrameRed {
+		for i, g := range m.fs {
+			if g == nil {
+				return fmt.Errorf("missing frame %d in three-pass image", i)
+			}
+		}
+		for _, g := range m.fs[1:] {
+			if g.Width != m.fs[0].Width || g.Height != m.fs[0].Height {
+				return fmt.Errorf("mismatched frame sizes in three-pass image")
+			}
+		}
+	} else if m.fs[1] != nil || m.fs[2] != nil {
+		return fmt.Errorf("unexpected frames in single-pass image")
+	}
+	return nil
+}
+
 func (c *Conn) loadImage() (*Image, error) {
 	m := Image{}
 	for {
-		f, err := c.ReadFrame()
+		// Reading past the last frame starts the next image, if any.
+		f, err := c.readFrame()
 		if err != nil {
+			m.Release()
 			return nil, err
 		}
-		switch f.Format {
-		case FrameGray, FrameRgb, FrameRed:
-			m.fs[0] = f
-		case FrameGreen:
-			m.fs[1] = f
-		case FrameBlue:
-			m.fs[2] = f
-		default:
-			return nil, fmt.Errorf("unknown frame type %d", f.Format)
+		// Frames may arrive in any order; place them by format.
+		i, err := plane(f.Format)
+		if err == nil && m.fs[i] != nil {
+			err = fmt.Errorf("duplicate %v frame", f.Format)
 		}
+		if err != nil {
+			f.Release()
+			m.Release()
+			return nil, err
+		}
+		m.fs[i] = f
 		if f.IsLast {
 			break
 		}
 	}
+	if err := m.checkFrames(); err != nil {
+		m.Release()
+		return nil, err
+	}
 	return &m, nil
 }
 
-// ReadImage reads an image from the connection.
+// Release releases the frames making up the image, as in Frame.Release. The
+// image must not be used afterwards.
+func (m *Image) Release() {
+	for _, f := range m.fs {
+		if f != nil {
+			f.Release()
+		}
+	}
+}
+
+// ReadImage reads an image from the connection and then cancels the scan,
+// unless disabled with SetAutoCancel.
+//
+// The height of the image need not be known before scanning, as for hand
+// scanners, whose parameters report -1 lines. Frame data is read into a
+// buffer that grows as needed, and is then trimmed to the lines actually
+// scanned, dropping any incomplete last line, so that Bounds reflects the
+// true height.
 func (c *Conn) ReadImage() (*Image, error) {
-	defer c.Cancel()
+	if !c.noCancel {
+		defer c.Cancel()
+	}
 	return c.loadImage()
 }
 
 // ReadAvailableImages reads all available image from the connection.
 // This is required for example for duplex scanners like the Fujitsu
 // ix500 as ReadImage only fetches one page from the scanner.
+//
+// An empty feeder is not an error: if there are no pages to begin with, an
+// empty slice is returned with a nil error. Any other error, including one
+// before the first page, is returned with no images, except ErrDoubleFeed,
+// which is returned with the pages read before the suspect one.
+//
+// Images are returned in the order they were scanned. For duplex sources,
+// images at even indices are fronts and those at odd indices are backs, and
+// their Side is set accordingly.
 func (c *Conn) ReadAvailableImages() ([]*Image, error) {
+	return c.ReadImages(-1)
+}
+
+// ReadImages is like ReadAvailableImages, but reads at most n images,
+// leaving any further pages in the feeder. A negative n means no limit.
+func (c *Conn) ReadImages(n int) ([]*Image, error) {
+	return c.readImages(n, nil)
+}
+
+// ReadAvailableImagesFunc is like ReadAvailableImages, but calls fn with the
+// index of each image as soon as it has been read. If fn returns stop=true, the
+// batch finishes after that image, leaving any further pages in the feeder, and
+// the images read so far are returned. If fn returns an error, the batch is
+// aborted and the error returned.
+func (c *Conn) ReadAvailableImagesFunc(fn func(i int, m *Image) (stop bool, err error)) ([]*Image, error) {
+	return c.readImages(-1, fn)
+}
+
+// readImages reads at most n images, or all available if n is negative, as
+// described for ReadImages. If fn is not nil, it is called for each image as
+// described for ReadAvailableImagesFunc.
+func (c *Conn) readImages(n int, fn func(i int, m *Image) (stop bool, err error)) ([]*Image, error) {
 	defer c.Cancel()
 
+	sides := c.sides()
+
 	var images = []*Image{}
 
-	for {
+	for n < 0 || len(images) < n {
 		m, err := c.loadImage()
 		if err != nil {
-			if err == ErrEmpty && len(images) > 0 {
+			if err == ErrEmpty {
 				// This is expected in multi-page scenarios and signals
 				// there are no more pages to come.
 				break
@@ -135,7 +411,22 @@ func (c *Conn) ReadAvailableImages() ([]*Image, error) {
 			// Other errors are returned
 			return nil, err
 		}
+		if len(images) > 0 {
+			if err := c.checkFeed(images[len(images)-1], m); err != nil {
+				return images, err // keep the pages before the suspect one
+			}
+		}
+		m.Side = sides(len(images))
 		images = append(images, m)
+		if fn != nil {
+			stop, err := fn(len(images)-1, m)
+			if err != nil {
+				return nil, err
+			}
+			if stop {
+				break
+			}
+		}
 	}
 
 	return images, nil
@@ -143,9 +434,12 @@ func (c *Conn) ReadAvailableImages() ([]*Image, error) {
 
 // ContinuousRead reads all images from connection and process each image
 // Useful for ADF scanners, fetch images one by one is slow
+// The Side of each image is set as in ReadAvailableImages.
 func (c *Conn) ContinuousRead(process func(m *Image) error) error {
 	defer c.Cancel()
 
+	sides := c.sides()
+
 	var (
 		m   *Image
 		err error
@@ -155,10 +449,12 @@ func (c *Conn) ContinuousRead(process func(m *Image) error) error {
 	if err != nil {
 		return err
 	}
-	for {
+	m.Side = sides(0)
+	for i := 1; ; i++ {
 		if err := process(m); err != nil {
 			return err
 		}
+		prev := m
 		m, err = c.loadImage()
 		if err != nil {
 			if err == ErrEmpty {
@@ -167,6 +463,61 @@ func (c *Conn) ContinuousRead(process func(m *Image) error) error {
 			}
 			return err
 		}
+		if err := c.checkFeed(prev, m); err != nil {
+			return err
+		}
+		m.Side = sides(i)
 	}
 	return nil
 }
+
+// ContinuousReadContext is like ContinuousRead, but stops when the context is
+// done, cancelling any scan in progress, and returns the context's error.
+func (c *Conn) ContinuousReadContext(ctx context.Context, process func(m *Image) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := c.watch(ctx)
+	err := c.ContinuousRead(func(m *Image) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return process(m)
+	})
+	stop()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// watch aborts any pending operation once the context is done, until the
+// returned function is called.
+func (c *Conn) watch(ctx context.Context) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			c.abort() // makes the pending read fail
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// ContinuousReadSkipBlank is like ContinuousRead, but does not call process
+// for pages that are blank according to IsBlank with the given threshold.
+func (c *Conn) ContinuousReadSkipBlank(threshold float64, process func(m *Image) error) error {
+	return c.ContinuousRead(func(m *Image) error {
+		if m.IsBlank(threshold) {
+			return nil
+		}
+		return process(m)
+	})
+}
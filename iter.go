@@ -0,0 +1,44 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+// +build go1.23
+
+package sane
+
+import "iter"
+
+// Images returns an iterator over the available images, reading each one
+// only when the previous one has been processed. Unlike ReadAvailableImages,
+// it does not keep all images in memory at once.
+//
+// Iteration stops when the feeder is empty. As with ReadAvailableImages, an
+// empty feeder before the first image is not an error: nothing is yielded.
+// Other errors, including ErrDoubleFeed if double feed detection is enabled,
+// are yielded with a nil image and end the iteration.
+func (c *Conn) Images() iter.Seq2[*Image, error] {
+	return func(yield func(*Image, error) bool) {
+		defer c.Cancel()
+		sides := c.sides()
+		var prev *Image
+		for i := 0; ; i++ {
+			m, err := c.loadImage()
+			if err == ErrEmpty {
+				return
+			}
+			if err == nil {
+				err = c.checkFeed(prev, m)
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			m.Side = sides(i)
+			if !yield(m, nil) {
+				return
+			}
+			prev = m
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23 && sane_cgo
+// +build go1.23,sane_cgo
+
+package sane
+
+import "testing"
+
+func TestImages(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "test-picture", "Color pattern")
+		n := 0
+		for m, err := range c.Images() {
+			if err != nil {
+				t.Fatal("images failed:", err)
+			}
+			checkColor(t, m, 8)
+			n++
+		}
+		if n != 10 {
+			t.Fatalf("read %d images, should be 10", n)
+		}
+		// The feeder is now empty, which is not an error.
+		for _, err := range c.Images() {
+			t.Fatalf("empty feeder yielded an image or error: %v", err)
+		}
+	})
+}
+
+func TestImagesDoubleFeed(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		c.SetDoubleFeedDetection(true)
+		n := 0
+		for _, err := range c.Images() {
+			if err != nil {
+				if err != ErrDoubleFeed || n != 1 {
+					t.Fatalf("images returned wrong error after %d images: %v should be %v",
+						n, err, ErrDoubleFeed)
+				}
+				return
+			}
+			n++
+		}
+		t.Fatal("identical pages should be flagged as a double feed")
+	})
+}
@@ -0,0 +1,111 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"context"
+	"time"
+)
+
+// Option names used by backends for lamp control.
+var (
+	lampStatusOpts = []string{"lamp-status", "lamp-ready"}
+	lampSwitchOpts = []string{"lamp-switch", "lamp-on"}
+	lampOffOpts    = []string{"lamp-off-time", "lamp-timeout"}
+)
+
+const warmUpInterval = time.Second
+
+// firstOpt returns the first option among names that has type t and is
+// active, or nil if there is none.
+func (c *Conn) firstOpt(names []string, t Type) *Option {
+	for _, name := range names {
+		if o := findOpt(c.Options(), name); o != nil && o.Type == t && o.IsActive {
+			return o
+		}
+	}
+	return nil
+}
+
+// lampReady reports whether the lamp is ready. Without a status option, it
+// starts and cancels a scan, which fails with ErrWarmingUp or ErrBusy while
+// warming up.
+func (c *Conn) lampReady(status *Option) (bool, error) {
+	if status != nil {
+		v, err := c.GetOption(status.Name)
+		if err != nil {
+			return false, err
+		}
+		return v.(bool), nil
+	}
+	err := c.Start()
+	c.Cancel()
+	if err == ErrWarmingUp || err == ErrBusy {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// WarmUp turns on the lamp, if the device allows it, and blocks until it is
+// ready or the context is done. It reads the lamp status if the device
+// reports it, and otherwise probes the device by periodically starting a scan.
+func (c *Conn) WarmUp(ctx context.Context) error {
+	if o := c.firstOpt(lampSwitchOpts, TypeBool); o != nil && o.IsSettable {
+		if _, err := c.SetOption(o.Name, true); err != nil {
+			return err
+		}
+	}
+	status := c.firstOpt(lampStatusOpts, TypeBool)
+	t := time.NewTicker(warmUpInterval)
+	defer t.Stop()
+	for {
+		ok, err := c.lampReady(status)
+		if err != nil || ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// SetLamp turns the lamp on or off. It returns ErrUnsupported if the device
+// has no lamp switch.
+func (c *Conn) SetLamp(on bool) error {
+	o := c.firstOpt(lampSwitchOpts, TypeBool)
+	if o == nil {
+		return ErrUnsupported
+	}
+	_, err := c.SetOption(o.Name, on)
+	return err
+}
+
+// LampOffTime returns the idle time after which the lamp turns off, in the
+// units used by the backend (usually minutes). It returns ErrUnsupported if
+// the device has no such setting.
+func (c *Conn) LampOffTime() (int, error) {
+	o := c.firstOpt(lampOffOpts, TypeInt)
+	if o == nil {
+		return 0, ErrUnsupported
+	}
+	v, err := c.GetOption(o.Name)
+	if err != nil {
+		return 0, err
+	}
+	return v.(int), nil
+}
+
+// SetLampOffTime sets the idle time after which the lamp turns off, as
+// described in LampOffTime.
+func (c *Conn) SetLampOffTime(t int) error {
+	o := c.firstOpt(lampOffOpts, TypeInt)
+	if o == nil {
+		return ErrUnsupported
+	}
+	_, err := c.SetOption(o.Name, t)
+	return err
+}
@@ -0,0 +1,377 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// ErrNoSource is returned by Sources and SetSource when the device has no
+// source option.
+var ErrNoSource = errors.New("sane: no source option")
+
+// Option returns the descriptor of the named option. The descriptor is
+// shared with Options and must not be modified; it becomes stale when options
+// are reloaded.
+func (c *Conn) Option(name string) (*Option, bool) {
+	o := findOpt(c.Options(), name)
+	return o, o != nil
+}
+
+// OptionMap returns the descriptors of all options, indexed by name. As with
+// Option, the descriptors are shared and become stale when options are
+// reloaded.
+func (c *Conn) OptionMap() map[string]*Option {
+	opts := c.Options()
+	m := make(map[string]*Option, len(opts))
+	for i := range opts {
+		m[opts[i].Name] = &opts[i]
+	}
+	return m
+}
+
+// Clone returns a copy of o that shares no memory with it, so that it does
+// not change when the original descriptor is modified.
+func (o Option) Clone() Option {
+	if o.ConstrSet != nil {
+		o.ConstrSet = append([]interface{}{}, o.ConstrSet...)
+	}
+	if o.ConstrRange != nil {
+		r := *o.ConstrRange
+		o.ConstrRange = &r
+	}
+	return o
+}
+
+// An OptionTypeError is returned by the typed option getters, such as
+// GetInt, when the option does not hold a value of the requested type. It
+// wraps ErrInvalid.
+type OptionTypeError struct {
+	Name string // option name
+	Type Type   // requested type
+	List bool   // whether a list of values was requested
+}
+
+func (e *OptionTypeError) Error() string {
+	if e.List {
+		return fmt.Sprintf("sane: option %s is not a list of type %v", e.Name, e.Type)
+	}
+	return fmt.Sprintf("sane: option %s is not of type %v", e.Name, e.Type)
+}
+
+// Unwrap returns ErrInvalid.
+func (e *OptionTypeError) Unwrap() error {
+	return ErrInvalid
+}
+
+// getTyped returns the value of the named option, which must have type t.
+func (c *Conn) getTyped(name string, t Type, list bool) (interface{}, error) {
+	o := findOpt(c.Options(), name)
+	if o == nil {
+		return nil, fmt.Errorf("no option named %s", name)
+	}
+	if o.Type != t || (o.Length > 1 && !list) {
+		return nil, &OptionTypeError{name, t, list}
+	}
+	return c.getOpt(o)
+}
+
+// GetInt returns the value of the named int option. It returns an
+// OptionTypeError if the option does not hold a single int.
+func (c *Conn) GetInt(name string) (int, error) {
+	v, err := c.getTyped(name, TypeInt, false)
+	if err != nil {
+		return 0, err
+	}
+	return v.(int), nil
+}
+
+// GetFloat returns the value of the named float option, as GetInt.
+func (c *Conn) GetFloat(name string) (float64, error) {
+	v, err := c.getTyped(name, TypeFloat, false)
+	if err != nil {
+		return 0, err
+	}
+	return v.(float64), nil
+}
+
+// GetBool returns the value of the named bool option, as GetInt.
+func (c *Conn) GetBool(name string) (bool, error) {
+	v, err := c.getTyped(name, TypeBool, false)
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+// GetString returns the value of the named string option, as GetInt.
+func (c *Conn) GetString(name string) (string, error) {
+	v, err := c.getTyped(name, TypeString, false)
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// GetIntList returns the values of the named int option, which may hold one
+// or more values. It returns an OptionTypeError for options of other types.
+func (c *Conn) GetIntList(name string) ([]int, error) {
+	v, err := c.getTyped(name, TypeInt, true)
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := v.(int); ok {
+		return []int{n}, nil
+	}
+	return v.([]int), nil
+}
+
+// optState is the descriptor and, if readable, the value of an option.
+type optState struct {
+	opt Option
+	val interface{}
+}
+
+// optionStates returns the state of all options, in order.
+func (c *Conn) optionStates() []optState {
+	opts := c.Options()
+	states := make([]optState, len(opts))
+	for i, o := range opts {
+		states[i].opt = o
+		if o.IsActive && o.IsDetectable && o.Type != TypeButton {
+			states[i].val, _ = c.getOpt(&opts[i])
+		}
+	}
+	return states
+}
+
+// changedOptions returns the names of options that were added, removed
+// or changed in value or descriptor between before and after.
+func changedOptions(before, after []optState) (names []string) {
+	old := make(map[string]optState, len(before))
+	for _, s := range before {
+		old[s.opt.Name] = s
+	}
+	for _, s := range after {
+		if o, ok := old[s.opt.Name]; !ok || !reflect.DeepEqual(o, s) {
+			names = append(names, s.opt.Name)
+		}
+		delete(old, s.opt.Name)
+	}
+	for _, s := range before {
+		if _, ok := old[s.opt.Name]; ok {
+			names = append(names, s.opt.Name)
+		}
+	}
+	return
+}
+
+// SetOptionChangeHook registers fn to be called after setting an option
+// causes options to be reloaded. It receives the names of the options whose
+// value, availability or constraints changed as a result. Computing these
+// requires reading all options before and after each set, so the hook should
+// only be registered when needed. A nil fn removes the hook.
+func (c *Conn) SetOptionChangeHook(fn func(changed []string)) {
+	c.changeHook = fn
+}
+
+// EnableOptionCache makes GetOption and GetOptionByIndex cache the values of
+// settable options, saving a round trip to the backend on repeated reads.
+// Cached values are discarded when they are set or when options are reloaded.
+// Values returned from the cache are shared and must not be modified.
+func (c *Conn) EnableOptionCache() {
+	if c.values == nil {
+		c.values = map[int]interface{}{}
+	}
+}
+
+// InvalidateOptions discards all cached option descriptors and values, as well
+// as the result of OptionDependencies, so that they are read again from the
+// backend. This is needed if the device changes them without being told to.
+func (c *Conn) InvalidateOptions() {
+	c.options = nil
+	c.deps = nil
+	if c.values != nil {
+		c.values = map[int]interface{}{}
+	}
+}
+
+// Refresh reads all option descriptors again from the backend, discarding any
+// cached descriptors and values as InvalidateOptions does, and returns them.
+// The option change hook is called if any options changed. It fails with
+// ErrClosed if the connection is closed.
+func (c *Conn) Refresh() ([]Option, error) {
+	if c.handle == nil {
+		return nil, ErrClosed
+	}
+	var before []optState
+	if c.changeHook != nil {
+		before = c.optionStates()
+	}
+	c.InvalidateOptions()
+	opts := c.Options()
+	if c.changeHook != nil {
+		if changed := changedOptions(before, c.optionStates()); len(changed) > 0 {
+			c.changeHook(changed)
+		}
+	}
+	return opts, nil
+}
+
+// Sources returns the scan sources supported by the device, such as
+// "Flatbed" or "ADF", from the constraint of its source option.
+func (c *Conn) Sources() ([]string, error) {
+	o := findOpt(c.Options(), "source")
+	if o == nil || o.Type != TypeString {
+		return nil, ErrNoSource
+	}
+	srcs := make([]string, 0, len(o.ConstrSet))
+	for _, v := range o.ConstrSet {
+		srcs = append(srcs, v.(string))
+	}
+	return srcs, nil
+}
+
+// SetSource selects the scan source, which must be one of those returned by
+// Sources.
+func (c *Conn) SetSource(src string) error {
+	srcs, err := c.Sources()
+	if err != nil {
+		return err
+	}
+	for _, s := range srcs {
+		if s == src {
+			_, err := c.SetOption("source", src)
+			return err
+		}
+	}
+	return fmt.Errorf("unsupported source %s", src)
+}
+
+// Options switching between single-pass and three-pass color scans, as named
+// by various backends.
+var threePassOpts = []string{"three-pass"}
+
+// SetInterleaved sets whether color images are scanned in a single frame of
+// interleaved RGB samples or, if not, in three separate frames. It returns
+// ErrUnsupported if the device has no such setting. Whether to expect one or
+// three frames can be checked with IsMultiFrame or Params.Frames before
+// scanning, as Params reports FrameRgb or FrameRed accordingly.
+func (c *Conn) SetInterleaved(interleaved bool) error {
+	o := c.firstOpt(threePassOpts, TypeBool)
+	if o == nil {
+		return ErrUnsupported
+	}
+	_, err := c.SetOption(o.Name, !interleaved)
+	return err
+}
+
+// SetLenientStrings enables or disables lenient matching of string values.
+// When enabled, SetOption matches values for options with a string list
+// constraint against the list ignoring case and surrounding whitespace, and
+// sets the matching list entry instead. Values matching no entry fail with
+// ErrInvalid.
+func (c *Conn) SetLenientStrings(enabled bool) {
+	c.lenient = enabled
+}
+
+// canonical returns the entry in the string list constraint of o that
+// matches v ignoring case and surrounding whitespace.
+func canonical(o *Option, v string) (string, error) {
+	v = strings.TrimSpace(v)
+	for _, s := range o.ConstrSet {
+		if s := s.(string); strings.EqualFold(s, v) {
+			return s, nil
+		}
+	}
+	return "", ErrInvalid
+}
+
+// setListed sets a string option to v, which must satisfy the option's
+// string list constraint, if any.
+func (c *Conn) setListed(name, v string) error {
+	o := findOpt(c.Options(), name)
+	if o == nil {
+		return fmt.Errorf("no option named %s", name)
+	}
+	if len(o.ConstrSet) > 0 {
+		found := false
+		for _, s := range o.ConstrSet {
+			found = found || s == v
+		}
+		if !found {
+			return fmt.Errorf("option %s does not accept %s", name, v)
+		}
+	}
+	_, err := c.SetOption(name, v)
+	return err
+}
+
+// resolutionOpts returns the names of the options that control the scan
+// resolution: either a single resolution option or separate options for
+// each axis.
+func (c *Conn) resolutionOpts() ([]string, error) {
+	opts := c.Options()
+	if findOpt(opts, "resolution") != nil {
+		return []string{"resolution"}, nil
+	}
+	if findOpt(opts, "x-resolution") != nil && findOpt(opts, "y-resolution") != nil {
+		return []string{"x-resolution", "y-resolution"}, nil
+	}
+	return nil, fmt.Errorf("no resolution option")
+}
+
+// Resolution returns the current scan resolution in DPI. For devices with
+// separate resolutions for each axis, it returns the horizontal resolution.
+func (c *Conn) Resolution() (int, error) {
+	names, err := c.resolutionOpts()
+	if err != nil {
+		return 0, err
+	}
+	v, err := c.GetOption(names[0])
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Floor(toFloat(v) + 0.5)), nil
+}
+
+// SetResolution sets the scan resolution to the supported value closest to
+// dpi, on both axes for devices with separate resolutions for each axis.
+// It returns the resolution actually applied.
+func (c *Conn) SetResolution(dpi int) (int, error) {
+	names, err := c.resolutionOpts()
+	if err != nil {
+		return 0, err
+	}
+	var applied float64
+	for i, name := range names {
+		v, _, err := c.SetOptionNearest(name, float64(dpi))
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 {
+			applied = v
+		}
+	}
+	return int(math.Floor(applied + 0.5)), nil
+}
+
+// PressButton actuates the named button option, such as a control to start
+// calibration.
+func (c *Conn) PressButton(name string) error {
+	o := findOpt(c.Options(), name)
+	if o == nil {
+		return fmt.Errorf("no option named %s", name)
+	}
+	if o.Type != TypeButton {
+		return fmt.Errorf("option %s is not a button", name)
+	}
+	_, err := c.setOpt(o, nil)
+	return err
+}
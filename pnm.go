@@ -0,0 +1,137 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// EncodePNM writes the image to w in NetPBM format: PBM for 1-bit gray
+// images, PGM for other gray images and PPM for color images. 16-bit samples
+// are written in big-endian order, as required by the format.
+func (m *Image) EncodePNM(w io.Writer) error {
+	f := m.fs[0]
+	bw := bufio.NewWriter(w)
+	if f.Format == FrameGray && f.Depth == 1 {
+		fmt.Fprintf(bw, "P4\n%d %d\n", f.Width, f.Height)
+		for y := 0; y < f.Height; y++ {
+			var b byte
+			for x := 0; x < f.Width; x++ {
+				if f.AtUnchecked(x, y, 0) == 0 {
+					b |= 0x80 >> uint(x%8) // 1 is black in PBM
+				}
+				if x%8 == 7 || x == f.Width-1 {
+					bw.WriteByte(b)
+					b = 0
+				}
+			}
+		}
+		return bw.Flush()
+	}
+	magic := "P6"
+	if f.Format == FrameGray {
+		magic = "P5"
+	}
+	fmt.Fprintf(bw, "%s\n%d %d\n%d\n", magic, f.Width, f.Height, m.maxSample())
+	nch := m.channels()
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			for i := 0; i < nch; i++ {
+				v := m.sampleAt(x, y, i)
+				if f.Depth == 16 {
+					bw.WriteByte(byte(v >> 8))
+				}
+				bw.WriteByte(byte(v))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// ErrNoPNM is returned by ScanPNM for scans that cannot be streamed in
+// NetPBM format.
+var ErrNoPNM = errors.New("sane: scan cannot be streamed as PNM")
+
+// ScanPNM scans an image and writes it to w in NetPBM format, as EncodePNM
+// does, but streams the data from the device without holding the whole image
+// in memory. It fails with ErrNoPNM without scanning if the image is scanned
+// in three passes, has 1-bit color samples or an unsupported depth, or is of
+// unknown height, since the data cannot then be written in order or the
+// header cannot be written first. Samples of 9 to 15 bits are written as
+// they are, with a matching maximum value in the header.
+func (c *Conn) ScanPNM(w io.Writer) error {
+	defer c.Cancel()
+	p, err := c.Params()
+	if err != nil {
+		return err
+	}
+	if (p.Format != FrameGray && p.Format != FrameRgb) || p.Lines < 0 ||
+		(p.Format == FrameRgb && p.Depth == 1) || !supportedDepth(p.Depth) {
+		return ErrNoPNM
+	}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	if p, err = c.Params(); err != nil {
+		return err
+	}
+	nch := 1
+	if p.Format == FrameRgb {
+		nch = 3
+	}
+	bw := bufio.NewWriter(w)
+	switch {
+	case p.Depth == 1:
+		fmt.Fprintf(bw, "P4\n%d %d\n", p.PixelsPerLine, p.Lines)
+	case nch == 1:
+		fmt.Fprintf(bw, "P5\n%d %d\n%d\n", p.PixelsPerLine, p.Lines, 1<<uint(p.Depth)-1)
+	default:
+		fmt.Fprintf(bw, "P6\n%d %d\n%d\n", p.PixelsPerLine, p.Lines, 1<<uint(p.Depth)-1)
+	}
+	n := c.bufSize
+	if n <= 0 {
+		n = defaultReadLines * p.BytesPerLine
+	}
+	br := bufio.NewReaderSize(c, n)
+	line := make([]byte, p.BytesPerLine)
+	out := line[:lineBytes(p.PixelsPerLine, nch, p.Depth)] // without padding
+	for y := 0; y < p.Lines; y++ {
+		if _, err := io.ReadFull(br, line); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		switch {
+		case p.Depth == 1:
+			for i, b := range out {
+				out[i] = reverseBits(b) // At reads the lowest bit first
+			}
+			if r := p.PixelsPerLine % 8; r != 0 {
+				out[len(out)-1] &= 0xff << uint(8-r) // clear unused bits
+			}
+		case p.Depth > 8:
+			for i := 0; i+1 < len(out); i += 2 {
+				out[i], out[i+1] = out[i+1], out[i] // big-endian
+			}
+		}
+		if _, err := bw.Write(out); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// reverseBits returns b with its bits in reverse order.
+func reverseBits(b byte) byte {
+	var r byte
+	for i := uint(0); i < 8; i++ {
+		r |= (b >> i & 1) << (7 - i)
+	}
+	return r
+}
@@ -0,0 +1,184 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"fmt"
+	"sync"
+)
+
+// optValue is the value of a named option.
+type optValue struct {
+	name string
+	val  interface{}
+}
+
+// snapshot returns the current values of all options that can be restored.
+func (c *Conn) snapshot() (vals []optValue) {
+	for _, o := range c.Options() {
+		if !o.IsActive || !o.IsSettable || !o.IsDetectable || o.Type == TypeButton {
+			continue
+		}
+		if v, err := c.GetOption(o.Name); err == nil {
+			vals = append(vals, optValue{o.Name, v})
+		}
+	}
+	return
+}
+
+// restore sets options to the values in vals, in order. Options that are
+// missing or inactive at the time they would be set are skipped.
+func (c *Conn) restore(vals []optValue) error {
+	for _, v := range vals {
+		o := findOpt(c.Options(), v.name)
+		if o == nil || !o.IsActive {
+			continue
+		}
+		if _, err := c.SetOption(v.name, v.val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveDefaults records the current option values for RestoreDefaults, if
+// not already done. It is called before an option is first set, rather than
+// when the connection is opened, to save reading every option up front.
+func (c *Conn) saveDefaults() {
+	if !c.savedDefaults {
+		c.savedDefaults = true
+		c.defaults = c.snapshot()
+	}
+}
+
+// RestoreDefaults sets all options back to the values they had when the
+// connection was opened. SANE does not describe option defaults, so these
+// are the values the backend chose at that time, which are usually its
+// defaults unless the device keeps its settings across connections.
+func (c *Conn) RestoreDefaults() error {
+	if !c.savedDefaults {
+		return nil // no option was set
+	}
+	return c.restore(c.defaults)
+}
+
+// ConnPool is a pool of connections to a device. It amortizes the cost of
+// opening a connection over many short jobs. It is safe for concurrent use.
+type ConnPool struct {
+	device string
+	idle   chan *Conn
+	sem    chan struct{} // holds a token for each open connection
+	mu     sync.Mutex    // protects closed, held by Put to return connections
+	closed bool
+}
+
+// NewConnPool returns a pool of at most size connections to the named device.
+// It opens one connection right away to check that the device is available.
+func NewConnPool(device string, size int) (*ConnPool, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid pool size %d", size)
+	}
+	p := &ConnPool{
+		device: device,
+		idle:   make(chan *Conn, size),
+		sem:    make(chan struct{}, size),
+	}
+	p.sem <- struct{}{}
+	c, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	p.idle <- c
+	return p, nil
+}
+
+// open opens a new connection. The caller must hold a token in p.sem, which
+// is released if opening fails.
+func (p *ConnPool) open() (*Conn, error) {
+	c, err := Open(p.device)
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *ConnPool) discard(c *Conn) {
+	c.Close()
+	<-p.sem
+}
+
+func (p *ConnPool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// Get returns an idle connection from the pool, opening a new one if there
+// is none and the pool is not full. Otherwise, it blocks until a connection
+// is returned with Put. It fails with ErrClosed once the pool is closed.
+func (p *ConnPool) Get() (*Conn, error) {
+	if p.isClosed() {
+		return nil, ErrClosed
+	}
+	var (
+		c   *Conn
+		err error
+	)
+	select {
+	case c = <-p.idle:
+	default:
+		select {
+		case c = <-p.idle:
+		case p.sem <- struct{}{}:
+			if c, err = p.open(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.isClosed() { // closed while waiting
+		p.discard(c)
+		return nil, ErrClosed
+	}
+	return c, nil
+}
+
+// Put returns a connection obtained from Get to the pool, cancelling any
+// pending operation and resetting its options to the values they had when
+// it was opened. Connections that cannot be reset are closed.
+func (p *ConnPool) Put(c *Conn) {
+	c.Cancel()
+	if p.isClosed() {
+		p.discard(c)
+		return
+	}
+	if err := c.RestoreDefaults(); err != nil {
+		p.discard(c)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.discard(c)
+		return
+	}
+	p.idle <- c // never blocks, as there are at most size connections
+}
+
+// Close closes all idle connections in the pool. Connections in use are
+// closed when they are returned with Put.
+func (p *ConnPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	for {
+		select {
+		case c := <-p.idle:
+			p.discard(c)
+		default:
+			return
+		}
+	}
+}
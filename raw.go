@@ -0,0 +1,149 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// rawMagic starts every raw frame dump.
+const rawMagic = "SANERAW1"
+
+// ErrBadDump is returned by LoadRawFrames for malformed input.
+var ErrBadDump = errors.New("sane: malformed raw frame dump")
+
+// rawHeader precedes the data of each frame in a raw frame dump, and is
+// followed by Height*BytesPerLine bytes of frame data.
+type rawHeader struct {
+	Format       int32
+	Width        int32
+	Height       int32
+	Depth        int32
+	BytesPerLine int32
+	IsLast       bool
+}
+
+// DumpRawFrames reads an image from the connection and writes its frames to w
+// as they arrive from the backend, in a zlib-compressed stream that can be
+// read back with LoadRawFrames. Samples of 9 to 15 bits are written as sent,
+// and only scaled to 16 bits when loaded.
+func (c *Conn) DumpRawFrames(w io.Writer) error {
+	defer c.Cancel()
+	z := zlib.NewWriter(w)
+	if _, err := io.WriteString(z, rawMagic); err != nil {
+		return err
+	}
+	for {
+		f, err := c.readRawFrame()
+		if err != nil {
+			return err
+		}
+		h := rawHeader{
+			Format:       int32(f.Format),
+			Width:        int32(f.Width),
+			Height:       int32(f.Height),
+			Depth:        int32(f.Depth),
+			BytesPerLine: int32(f.BytesPerLine),
+			IsLast:       f.IsLast,
+		}
+		err = binary.Write(z, binary.BigEndian, &h)
+		if err == nil {
+			_, err = z.Write(f.data)
+		}
+		last := f.IsLast
+		f.Release()
+		if err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+	return z.Close()
+}
+
+// LoadRawFrames reconstructs an image from a dump written by DumpRawFrames.
+func LoadRawFrames(r io.Reader) (*Image, error) {
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	magic := make([]byte, len(rawMagic))
+	if _, err := io.ReadFull(z, magic); err != nil || string(magic) != rawMagic {
+		return nil, ErrBadDump
+	}
+	m := Image{}
+	for {
+		var h rawHeader
+		if err := binary.Read(z, binary.BigEndian, &h); err != nil {
+			return nil, ErrBadDump
+		}
+		f, err := rawFrame(z, h)
+		if err != nil {
+			return nil, err
+		}
+		i, err := plane(f.Format)
+		if err != nil {
+			return nil, err
+		}
+		if m.fs[i] != nil {
+			return nil, ErrBadDump
+		}
+		m.fs[i] = f
+		if f.IsLast {
+			break
+		}
+	}
+	if err := m.checkFrames(); err != nil {
+		return nil, ErrBadDump
+	}
+	return &m, nil
+}
+
+// rawFrame checks that the properties given by h are consistent and returns
+// a frame with them, holding data read from r. The data is read before being
+// stored, so that a corrupt header cannot cause a huge allocation.
+func rawFrame(r io.Reader, h rawHeader) (*Frame, error) {
+	w, height, depth := int(h.Width), int(h.Height), int(h.Depth)
+	if h.Width <= 0 || h.Height < 0 || !supportedDepth(depth) ||
+		h.Format < int32(FrameGray) || h.Format > int32(FrameBlue) {
+		return nil, ErrBadDump
+	}
+	nch := 1
+	if Format(h.Format) == FrameRgb {
+		nch = 3
+	}
+	n0, bpl := lineBytes(w, nch, depth), int(h.BytesPerLine)
+	if bpl < n0 {
+		return nil, ErrBadDump
+	}
+	n := int64(height) * int64(bpl)
+	if int64(int(n)) != n {
+		return nil, ErrBadDump
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, n))
+	if err != nil || int64(len(data)) != n {
+		return nil, ErrBadDump
+	}
+	f := &Frame{
+		Format:       Format(h.Format),
+		Width:        w,
+		Height:       height,
+		Channels:     nch,
+		Depth:        depth,
+		IsLast:       h.IsLast,
+		BytesPerLine: bpl,
+		Pad:          bpl - n0,
+		data:         data}
+	if depth > 8 && depth < 16 {
+		f.widen()
+	}
+	return f, nil
+}
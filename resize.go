@@ -0,0 +1,86 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import "math"
+
+// contrib is the contribution of a source sample to a resampled sample.
+type contrib struct {
+	i int     // source index
+	w float64 // weight
+}
+
+// areaWeights returns, for each of dn destination samples, the contributions
+// of the sn source samples it covers, weighted by the covered area.
+func areaWeights(sn, dn int) [][]contrib {
+	scale := float64(sn) / float64(dn)
+	ws := make([][]contrib, dn)
+	for d := range ws {
+		lo, hi := float64(d)*scale, float64(d+1)*scale
+		for s := int(lo); s < sn && float64(s) < hi; s++ {
+			if ov := math.Min(hi, float64(s+1)) - math.Max(lo, float64(s)); ov > 0 {
+				ws[d] = append(ws[d], contrib{s, ov / scale})
+			}
+		}
+	}
+	return ws
+}
+
+// Resize returns a copy of the image scaled to w x h pixels. Each output
+// pixel is the average of the input pixels it covers, which gives good
+// results when downscaling. The color model is preserved, except that
+// bilevel images are resized as 8-bit images to avoid aliasing; use
+// Threshold to make them bilevel again.
+func (m *Image) Resize(w, h int) *Image {
+	if w < 0 {
+		w = 0
+	}
+	if h < 0 {
+		h = 0
+	}
+	sw, sh := m.fs[0].Width, m.fs[0].Height
+	xw, yw := areaWeights(sw, w), areaWeights(sh, h)
+	return m.mapFrames(func(f *Frame) *Frame {
+		depth, scale := f.Depth, 1.0
+		if depth == 1 {
+			depth, scale = 8, 0xff
+		}
+		g := makeFrame(f.Format, w, h, depth)
+		g.IsLast = f.IsLast
+		row := make([]float64, w*sh) // horizontally resampled samples
+		for ch := 0; ch < f.Channels; ch++ {
+			for y := 0; y < sh; y++ {
+				for x, cs := range xw {
+					v := 0.0
+					for _, c := range cs {
+						v += c.w * float64(f.AtUnchecked(c.i, y, ch))
+					}
+					row[y*w+x] = v * scale
+				}
+			}
+			for y, cs := range yw {
+				for x := 0; x < w; x++ {
+					v := 0.0
+					for _, c := range cs {
+						v += c.w * row[c.i*w+x]
+					}
+					g.set(x, y, ch, uint16(math.Floor(v+0.5)))
+				}
+			}
+		}
+		return g
+	})
+}
+
+// ResizeDPI returns a copy of the image, scanned at from DPI, resampled to
+// to DPI, as with Resize. If either resolution is not positive, as when it is
+// unknown, m is returned unchanged.
+func (m *Image) ResizeDPI(from, to int) *Image {
+	if from <= 0 || to <= 0 {
+		return m
+	}
+	b := m.Bounds()
+	return m.Resize(b.Dx()*to/from, b.Dy()*to/from)
+}
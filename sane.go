@@ -4,16 +4,17 @@
 
 package sane
 
-// #cgo LDFLAGS: -lsane
-// #include <stdlib.h>
-// #include <sane/sane.h>
-import "C"
-
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -23,47 +24,93 @@ var (
 	floatType = reflect.TypeOf(0.0)
 )
 
-const wordSize = unsafe.Sizeof(C.SANE_Word(0))
-
 // Type represents the data type of an option.
 type Type int
 
-// Type constants.
+// Type constants, with the values defined by the SANE standard.
 const (
-	TypeBool   Type = C.SANE_TYPE_BOOL
-	TypeInt         = C.SANE_TYPE_INT
-	TypeFloat       = C.SANE_TYPE_FIXED
-	TypeString      = C.SANE_TYPE_STRING
-	TypeButton      = C.SANE_TYPE_BUTTON
-	typeGroup       = C.SANE_TYPE_GROUP // internal use only
+	TypeBool   Type = 0
+	TypeInt    Type = 1
+	TypeFloat  Type = 2
+	TypeString Type = 3
+	TypeButton Type = 4
+	typeGroup  Type = 5 // internal use only
 )
 
+var typeNames = map[Type]string{
+	TypeBool:   "bool",
+	TypeInt:    "int",
+	TypeFloat:  "float",
+	TypeString: "string",
+	TypeButton: "button",
+	typeGroup:  "group",
+}
+
+func (t Type) String() string {
+	if s, ok := typeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
 // Unit represents the physical unit of an option.
 type Unit int
 
-// Unit constants.
+// Unit constants, with the values defined by the SANE standard.
 const (
-	UnitNone    Unit = C.SANE_UNIT_NONE
-	UnitPixel        = C.SANE_UNIT_PIXEL
-	UnitBit          = C.SANE_UNIT_BIT
-	UnitMm           = C.SANE_UNIT_MM
-	UnitDpi          = C.SANE_UNIT_DPI
-	UnitPercent      = C.SANE_UNIT_PERCENT
-	UnitUsec         = C.SANE_UNIT_MICROSECOND
+	UnitNone    Unit = 0
+	UnitPixel   Unit = 1
+	UnitBit     Unit = 2
+	UnitMm      Unit = 3
+	UnitDpi     Unit = 4
+	UnitPercent Unit = 5
+	UnitUsec    Unit = 6
 )
 
+var unitNames = map[Unit]string{
+	UnitNone:    "none",
+	UnitPixel:   "pixel",
+	UnitBit:     "bit",
+	UnitMm:      "mm",
+	UnitDpi:     "dpi",
+	UnitPercent: "percent",
+	UnitUsec:    "usec",
+}
+
+func (u Unit) String() string {
+	if s, ok := unitNames[u]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unit(%d)", int(u))
+}
+
 // Format represents the format of a frame.
 type Format int
 
-// Format constants.
+// Format constants, with the values defined by the SANE standard.
 const (
-	FrameGray  Format = C.SANE_FRAME_GRAY
-	FrameRgb          = C.SANE_FRAME_RGB
-	FrameRed          = C.SANE_FRAME_RED
-	FrameGreen        = C.SANE_FRAME_GREEN
-	FrameBlue         = C.SANE_FRAME_BLUE
+	FrameGray  Format = 0
+	FrameRgb   Format = 1
+	FrameRed   Format = 2
+	FrameGreen Format = 3
+	FrameBlue  Format = 4
 )
 
+var formatNames = map[Format]string{
+	FrameGray:  "gray",
+	FrameRgb:   "rgb",
+	FrameRed:   "red",
+	FrameGreen: "green",
+	FrameBlue:  "blue",
+}
+
+func (f Format) String() string {
+	if s, ok := formatNames[f]; ok {
+		return s
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
 // Info signals the side effects of setting an option.
 type Info struct {
 	Inexact      bool // option set to an approximate value
@@ -97,7 +144,7 @@ type Option struct {
 	IsAutomatic  bool          // whether option has an auto value
 	IsEmulated   bool          // whether option is emulated
 	IsAdvanced   bool          // whether option is advanced
-	index        int           // internal option index
+	Index        int           // option index, stable until options are reloaded
 	size         int           // internal option size in bytes
 }
 
@@ -111,15 +158,66 @@ type Device struct {
 	Name, Vendor, Model, Type string
 }
 
+const netPrefix = "net:"
+
+// IsNetwork reports whether the device is accessed through the net backend.
+func (d Device) IsNetwork() bool {
+	return strings.HasPrefix(d.Name, netPrefix)
+}
+
+// Backend returns the name of the backend driving the device. For network
+// devices, it is the backend on the remote host.
+func (d Device) Backend() string {
+	name := d.Name
+	if d.IsNetwork() {
+		// Skip the host, which may be a bracketed IPv6 address.
+		name = name[len(netPrefix):]
+		if strings.HasPrefix(name, "[") {
+			if i := strings.Index(name, "]"); i >= 0 {
+				name = name[i+1:]
+			}
+		}
+		if i := strings.Index(name, ":"); i >= 0 {
+			name = name[i+1:]
+		} else {
+			return ""
+		}
+	}
+	if i := strings.Index(name, ":"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
 // Conn is a connection to a scanning device. It can be used to get and set
 // scanning options or to read one or more frames.
 //
 // Conn implements the Reader interface. However, it only makes sense to call
 // Read after acquisition of a new frame is started by calling Start.
 type Conn struct {
-	Device  string // device name
-	handle  C.SANE_Handle
-	options []Option
+	Device   string         // device name
+	handle   unsafe.Pointer // SANE_Handle, nil once closed
+	options  []Option
+	mu       sync.Mutex  // guards started, done and closing the handle, for Cancel
+	started  bool        // whether a scan has been started and not yet cancelled
+	done     bool        // whether the last frame of the current image was read
+	deadline time.Time   // read deadline, zero if none
+	bufSize  int         // read buffer size, 0 for default
+	pool     BufferPool  // frame buffer pool, nil for none
+	scratch  scratchPool // frame buffers kept by ReadImageInto
+	noCancel bool        // whether ReadImage leaves the scan uncancelled
+
+	detectDoubleFeed bool                   // whether feeder functions check for double feeds
+	lenient          bool                   // whether string values are matched leniently
+	changeHook       func(changed []string) // called when options are reloaded
+	pollHook         func(pressed bool)     // called after each button poll, for tests
+	values           map[int]interface{}    // cached option values, nil if disabled
+	defaults         []optValue             // option values before the first set
+	savedDefaults    bool                   // whether defaults were recorded
+	info             Device                 // device descriptor at open time
+	listed           bool                   // whether devices were listed to fill in info
+	stats            ScanStats              // statistics for the current scan
+	deps             map[string][]string    // cached option dependencies
 }
 
 // Params describes the properties of a frame.
@@ -135,6 +233,14 @@ type Params struct {
 // Error represents a scanning error.
 type Error error
 
+// StatusError is returned for SANE status codes that are not defined by the
+// SANE standard, and holds the numeric code.
+type StatusError int
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("sane: unknown status code %d", int(e))
+}
+
 // Error constants.
 var (
 	ErrUnsupported = errors.New("sane: operation not supported")
@@ -147,464 +253,514 @@ var (
 	ErrIo          = errors.New("sane: input/output error")
 	ErrNoMem       = errors.New("sane: out of memory")
 	ErrDenied      = errors.New("sane: access denied")
+	ErrWarmingUp   = errors.New("sane: lamp warming up")
+	ErrLocked      = errors.New("sane: hardware locked")
+	ErrTimeout     = errors.New("sane: deadline exceeded")
+	ErrLastFrame   = errors.New("sane: last frame already read")
+	ErrClosed      = errors.New("sane: connection closed")
 )
 
-// mkError converts a libsane status code to an Error.
-func mkError(s C.SANE_Status) Error {
-	switch s {
-	case C.SANE_STATUS_UNSUPPORTED:
-		return ErrUnsupported
-	case C.SANE_STATUS_CANCELLED:
-		return ErrCancelled
-	case C.SANE_STATUS_DEVICE_BUSY:
-		return ErrBusy
-	case C.SANE_STATUS_INVAL:
-		return ErrInvalid
-	case C.SANE_STATUS_JAMMED:
-		return ErrJammed
-	case C.SANE_STATUS_NO_DOCS:
-		return ErrEmpty
-	case C.SANE_STATUS_COVER_OPEN:
-		return ErrCoverOpen
-	case C.SANE_STATUS_IO_ERROR:
-		return ErrIo
-	case C.SANE_STATUS_NO_MEM:
-		return ErrNoMem
-	case C.SANE_STATUS_ACCESS_DENIED:
-		return ErrDenied
-	default:
-		return fmt.Errorf("unknown error code %d", int(s))
-	}
-}
-
-func boolFromSane(b C.SANE_Word) bool {
-	return b != C.SANE_FALSE
-}
+var (
+	knownMu sync.Mutex        // protects known
+	known   map[string]Device // devices seen when listing devices, by name
+)
 
-func boolToSane(b bool) C.SANE_Word {
-	if b {
-		return C.SANE_TRUE
+// remember records devs for knownDevice.
+func remember(devs []Device) {
+	knownMu.Lock()
+	defer knownMu.Unlock()
+	if known == nil {
+		known = make(map[string]Device)
+	}
+	for _, d := range devs {
+		known[d.Name] = d
 	}
-	return C.SANE_FALSE
-}
-
-func intFromSane(i C.SANE_Word) int {
-	return int(i)
 }
 
-func intToSane(i int) C.SANE_Word {
-	return C.SANE_Word(i)
+// knownDevice returns the named device as last listed, or a Device with only
+// the name set if it was never listed.
+func knownDevice(name string) Device {
+	knownMu.Lock()
+	defer knownMu.Unlock()
+	if d, ok := known[name]; ok {
+		return d
+	}
+	return Device{Name: name}
 }
 
-func strFromSane(s C.SANE_String_Const) *C.char {
-	// Cast necessary on older Go versions.
-	return (*C.char)(unsafe.Pointer(s))
-}
+var (
+	authMu sync.Mutex                                    // protects authFn
+	authFn func(resource string) (user, password string) // set by SetAuthCallback
+)
 
-func strToSane(s *C.char) C.SANE_String_Const {
-	// Cast necessary on older Go versions.
-	return C.SANE_String_Const(unsafe.Pointer(s))
+// SetAuthCallback sets the function called when a backend, such as the net
+// backend talking to a password-protected saned, requests credentials for the
+// named resource. It may be called before or after Init, and fn may be nil to
+// send empty credentials. The callback may be called from any goroutine
+// performing a SANE operation, and should not call back into the package.
+func SetAuthCallback(fn func(resource string) (user, password string)) {
+	authMu.Lock()
+	authFn = fn
+	authMu.Unlock()
+}
+
+// credentials returns the credentials for resource from the auth callback.
+func credentials(resource string) (user, password string) {
+	authMu.Lock()
+	fn := authFn
+	authMu.Unlock()
+	if fn == nil {
+		return "", ""
+	}
+	return fn(resource)
 }
 
-func floatFromSane(f C.SANE_Word) float64 {
-	return float64(f) / (1 << C.SANE_FIXED_SCALE_SHIFT)
+// Devices lists all available devices.
+func Devices() (devs []Device, err error) {
+	return devices(false)
 }
 
-func floatToSane(f float64) C.SANE_Word {
-	return C.SANE_Word(f * (1 << C.SANE_FIXED_SCALE_SHIFT))
+// LocalDevices lists only local devices.
+func LocalDevices() (devs []Device, err error) {
+	return devices(true)
 }
 
-func nthWord(p *C.SANE_Word, i int) C.SANE_Word {
-	a := (*[1 << 16]C.SANE_Word)(unsafe.Pointer(p))
-	return a[i]
+// DevicesTimeout is like Devices, but gives up after d has elapsed and
+// returns ErrTimeout. Since devices are listed by a single library call, no
+// devices are returned in that case.
+//
+// The library call cannot be interrupted, so it keeps running in the
+// background after a timeout, and later calls listing devices wait for it
+// to complete. Exit must not be called until then.
+func DevicesTimeout(d time.Duration) ([]Device, error) {
+	type result struct {
+		devs []Device
+		err  error
+	}
+	ch := make(chan result, 1) // don't block the call after a timeout
+	go func() {
+		devs, err := devices(false)
+		ch <- result{devs, err}
+	}()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		return r.devs, r.err
+	case <-t.C:
+		return nil, ErrTimeout
+	}
 }
 
-func setNthWord(p *C.SANE_Word, i int, w C.SANE_Word) {
-	a := (*[1 << 16]C.SANE_Word)(unsafe.Pointer(p))
-	a[i] = w
+// OpenContext is like Open, but gives up and returns ctx.Err() if the context
+// is done before the connection is open.
+//
+// The library call cannot be interrupted, so it keeps running in the
+// background after the context is done, and the connection is closed as soon
+// as it opens. Exit must not be called until then.
+func OpenContext(ctx context.Context, name string) (*Conn, error) {
+	type result struct {
+		c   *Conn
+		err error
+	}
+	ch := make(chan result, 1) // don't block the call after cancellation
+	go func() {
+		c, err := Open(name)
+		ch <- result{c, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.c, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.err == nil {
+				r.c.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
 }
 
-func nthString(p *C.SANE_String_Const, i int) C.SANE_String_Const {
-	a := (*[1 << 16]C.SANE_String_Const)(unsafe.Pointer(p))
-	return a[i]
+// Probe checks that the named device can be used, by opening it, reading its
+// options and scan parameters and closing it again. Unlike Conn.Probe, it
+// does not start a scan, so it is cheap enough for periodic health checks.
+// Errors from Open, such as ErrBusy or ErrDenied, are returned unchanged.
+func Probe(name string) error {
+	c, err := Open(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if len(c.Options()) == 0 {
+		return fmt.Errorf("device %s reports no options", name)
+	}
+	_, err = c.Params()
+	return err
 }
 
-// Init must be called before the package can be used.
-func Init() error {
-	if s := C.sane_init(nil, nil); s != C.SANE_STATUS_GOOD {
-		return mkError(s)
+// findOpt returns the named option from opts, or nil if there is none.
+func findOpt(opts []Option, name string) *Option {
+	for i := range opts {
+		if opts[i].Name == name {
+			return &opts[i]
+		}
 	}
 	return nil
 }
 
-// Exit releases all resources in use, closing any open connections. The
-// package cannot be used after Exit returns and before Init is called again.
-func Exit() {
-	C.sane_exit()
-}
-
-func nthDevice(p **C.SANE_Device, i int) *C.SANE_Device {
-	a := (*[1 << 16]*C.SANE_Device)(unsafe.Pointer(p))
-	return a[i]
-}
-
-func devices(localOnly bool) (devs []Device, err error) {
-	var p **C.SANE_Device
-	saneLocalOnly := boolToSane(localOnly)
-	if s := C.sane_get_devices(&p, saneLocalOnly); s != C.SANE_STATUS_GOOD {
-		return nil, mkError(s)
-	}
-	for i := 0; nthDevice(p, i) != nil; i++ {
-		p := nthDevice(p, i)
-		devs = append(devs, Device{
-			C.GoString(strFromSane(p.name)),
-			C.GoString(strFromSane(p.vendor)),
-			C.GoString(strFromSane(p.model)),
-			C.GoString(strFromSane(p._type)),
-		})
+// GetOption gets the current value for the named option. If successful, it
+// returns a value of the appropriate type for the option.
+func (c *Conn) GetOption(name string) (interface{}, error) {
+	o := findOpt(c.Options(), name)
+	if o == nil {
+		return nil, fmt.Errorf("no option named %s", name)
 	}
-	return devs, nil
+	return c.getOpt(o)
 }
 
-// Devices lists all available devices.
-func Devices() (devs []Device, err error) {
-	return devices(false)
+// GetOptionByIndex is like GetOption, but identifies the option by its index
+// rather than its name. This avoids the lookup by name in tight loops.
+func (c *Conn) GetOptionByIndex(i int) (interface{}, error) {
+	o := c.optByIndex(i)
+	if o == nil {
+		return nil, fmt.Errorf("no option with index %d", i)
+	}
+	return c.getOpt(o)
 }
 
-// LocalDevices lists only local devices.
-func LocalDevices() (devs []Device, err error) {
-	return devices(true)
+// optByIndex returns the option with index i, or nil if there is none.
+func (c *Conn) optByIndex(i int) *Option {
+	opts := c.Options() // sorted by index
+	j := sort.Search(len(opts), func(j int) bool { return opts[j].Index >= i })
+	if j < len(opts) && opts[j].Index == i {
+		return &opts[j]
+	}
+	return nil
 }
 
-// Open opens a connection to a device with a given name.
-// The empty string opens the first available device.
-func Open(name string) (*Conn, error) {
-	var h C.SANE_Handle
-	cname := C.CString(name)
-	defer C.free(unsafe.Pointer(cname))
-	if s := C.sane_open(strToSane(cname), &h); s != C.SANE_STATUS_GOOD {
-		return nil, mkError(s)
+func (c *Conn) getOpt(o *Option) (interface{}, error) {
+	if v, ok := c.values[o.Index]; ok {
+		return v, nil
+	}
+	v, err := c.fetchOpt(o)
+	if err == nil && c.values != nil && o.IsSettable {
+		// Values of other options may change without notice.
+		c.values[o.Index] = v
+	}
+	return v, err
+}
+
+// convertNum converts v, which must be of a numeric kind, to a value of type
+// t, which must be int or float64. It reports whether conversion is possible
+// without loss of precision.
+func convertNum(v reflect.Value, t reflect.Type) (reflect.Value, bool) {
+	var f float64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if t == intType {
+			return reflect.ValueOf(int(v.Int())), int64(int(v.Int())) == v.Int()
+		}
+		f = float64(v.Int())
+		return reflect.ValueOf(f), int64(f) == v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if t == intType {
+			i := int(v.Uint())
+			return reflect.ValueOf(i), i >= 0 && uint64(i) == v.Uint()
+		}
+		f = float64(v.Uint())
+		return reflect.ValueOf(f), uint64(f) == v.Uint()
+	default: // float
+		f = v.Float()
+		if t == floatType {
+			return reflect.ValueOf(f), true
+		}
+		i := int(f)
+		return reflect.ValueOf(i), float64(i) == f
 	}
-	return &Conn{name, h, nil}, nil
 }
 
-// Start initiates the acquisition of a frame.
-func (c *Conn) Start() error {
-	if s := C.sane_start(c.handle); s != C.SANE_STATUS_GOOD {
-		return mkError(s)
-	}
-	return nil
+func isNumeric(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Uint64 || k == reflect.Float32 || k == reflect.Float64
 }
 
-func parseRangeConstr(d *C.SANE_Option_Descriptor, o *Option) {
-	r := *(**C.SANE_Range)(unsafe.Pointer(&d.constraint))
+// coerce converts a numeric value, or slice of numeric values, to the Go type
+// expected by an int or float option. Other values are returned unchanged.
+// It returns ErrInvalid if the conversion would lose precision.
+func coerce(o *Option, v interface{}) (interface{}, error) {
+	var t reflect.Type
 	switch o.Type {
 	case TypeInt:
-		o.ConstrRange = &Range{
-			intFromSane(r.min),
-			intFromSane(r.max),
-			intFromSane(r.quant)}
+		t = intType
 	case TypeFloat:
-		o.ConstrRange = &Range{
-			floatFromSane(r.min),
-			floatFromSane(r.max),
-			floatFromSane(r.quant)}
+		t = floatType
+	default:
+		return v, nil
 	}
-}
-
-func parseIntConstr(d *C.SANE_Option_Descriptor, o *Option) {
-	p := *(**C.SANE_Word)(unsafe.Pointer(&d.constraint))
-	n := intFromSane(nthWord(p, 0))
-	// First word is number of remaining words in array.
-	for i := 1; i <= n; i++ {
-		o.ConstrSet = append(o.ConstrSet, intFromSane(nthWord(p, i)))
+	rv := reflect.ValueOf(v)
+	switch {
+	case !rv.IsValid() || rv.Type() == t:
+		return v, nil
+	case isNumeric(rv.Kind()):
+		x, ok := convertNum(rv, t)
+		if !ok {
+			return nil, ErrInvalid
+		}
+		return x.Interface(), nil
+	case rv.Kind() == reflect.Slice && isNumeric(rv.Type().Elem().Kind()):
+		if rv.Type().Elem() == t {
+			return v, nil
+		}
+		s := reflect.MakeSlice(reflect.SliceOf(t), rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			x, ok := convertNum(rv.Index(i), t)
+			if !ok {
+				return nil, ErrInvalid
+			}
+			s.Index(i).Set(x)
+		}
+		return s.Interface(), nil
 	}
+	return v, nil
 }
 
-func parseFloatConstr(d *C.SANE_Option_Descriptor, o *Option) {
-	p := *(**C.SANE_Word)(unsafe.Pointer(&d.constraint))
-	n := intFromSane(nthWord(p, 0))
-	// First word is number of remaining words in array.
-	for i := 1; i <= n; i++ {
-		o.ConstrSet = append(o.ConstrSet, floatFromSane(nthWord(p, i)))
+// SetOption sets the value of the named option, which should be either of the
+// corresponding type, or Auto for automatic mode. If successful, info contains
+// information on the effects of setting the option.
+//
+// Numeric values of any Go type, and slices thereof, are converted to int for
+// int options and to float64 for float options, provided that the conversion
+// is lossless. Otherwise, SetOption returns ErrInvalid.
+func (c *Conn) SetOption(name string, v interface{}) (info Info, err error) {
+	o := findOpt(c.Options(), name)
+	if o == nil {
+		return info, fmt.Errorf("no option named %s", name)
 	}
+	return c.setOpt(o, v)
 }
 
-func parseStrConstr(d *C.SANE_Option_Descriptor, o *Option) {
-	p := *(**C.SANE_String_Const)(unsafe.Pointer(&d.constraint))
-	// Array is null-terminated.
-	for i := 0; nthString(p, i) != nil; i++ {
-		s := C.GoString(strFromSane(nthString(p, i)))
-		o.ConstrSet = append(o.ConstrSet, s)
+// SetOptionByIndex is like SetOption, but identifies the option by its index
+// rather than its name. This avoids the lookup by name in tight loops.
+func (c *Conn) SetOptionByIndex(i int, v interface{}) (info Info, err error) {
+	o := c.optByIndex(i)
+	if o == nil {
+		return info, fmt.Errorf("no option with index %d", i)
 	}
+	return c.setOpt(o, v)
 }
 
-func parseOpt(d *C.SANE_Option_Descriptor) (o Option) {
-	o.Name = C.GoString(strFromSane(d.name))
-	o.Title = C.GoString(strFromSane(d.title))
-	o.Desc = C.GoString(strFromSane(d.desc))
-	o.Type = Type(d._type)
-	o.Unit = Unit(d.unit)
-	o.size = int(d.size)
-	if o.Type == TypeInt || o.Type == TypeFloat {
-		o.Length = o.size / int(wordSize)
-	} else {
-		o.Length = 1
+func (c *Conn) setOpt(o *Option, v interface{}) (info Info, err error) {
+	c.saveDefaults()
+	var before []optState
+	if c.changeHook != nil {
+		before = c.optionStates()
 	}
-	switch d.constraint_type {
-	case C.SANE_CONSTRAINT_RANGE:
-		parseRangeConstr(d, &o)
-	case C.SANE_CONSTRAINT_WORD_LIST:
-		if o.Type == TypeInt {
-			parseIntConstr(d, &o)
-		} else {
-			parseFloatConstr(d, &o)
+	if _, ok := v.(autoType); !ok {
+		if v, err = coerce(o, v); err != nil {
+			return info, err
 		}
-	case C.SANE_CONSTRAINT_STRING_LIST:
-		parseStrConstr(d, &o)
-	}
-	o.IsActive = (d.cap & C.SANE_CAP_INACTIVE) == 0
-	o.IsSettable = (d.cap & C.SANE_CAP_SOFT_SELECT) != 0
-	o.IsDetectable = (d.cap & C.SANE_CAP_SOFT_DETECT) != 0
-	o.IsAutomatic = (d.cap & C.SANE_CAP_AUTOMATIC) != 0
-	o.IsEmulated = (d.cap & C.SANE_CAP_EMULATED) != 0
-	o.IsAdvanced = (d.cap & C.SANE_CAP_ADVANCED) != 0
-	return
-}
-
-// Options returns a list of available scanning options.
-// The list of options usually remains valid until the connection is closed,
-// but setting some options may affect the value or availability of others.
-func (c *Conn) Options() (opts []Option) {
-	if c.options != nil {
-		return c.options // use cached value
-	}
-	curgroup := ""
-	for i := 1; ; i++ {
-		desc := C.sane_get_option_descriptor(c.handle, C.SANE_Int(i))
-		if desc == nil {
-			break
-		}
-		opt := parseOpt(desc)
-		if opt.Type == typeGroup {
-			curgroup = opt.Title
-			continue
+	}
+	if s, ok := v.(string); ok && c.lenient && len(o.ConstrSet) > 0 {
+		if v, err = canonical(o, s); err != nil {
+			return info, err
 		}
-		opt.Group = curgroup
-		opt.index = i
-		opts = append(opts, opt)
-	}
-	c.options = opts
-	return
-}
-
-func readArrayAt(p unsafe.Pointer, i int, t reflect.Type) interface{} {
-	ptr := (*C.SANE_Word)(p)
-	switch t.Kind() {
-	case reflect.Bool:
-		return boolFromSane(nthWord(ptr, i))
-	case reflect.Int:
-		return intFromSane(nthWord(ptr, i))
-	case reflect.Float64:
-		return floatFromSane(nthWord(ptr, i))
-	default:
-		return nil
 	}
-}
-
-func readArray(p unsafe.Pointer, t reflect.Type, n int) interface{} {
-	if n == 1 {
-		return readArrayAt(p, 0, t)
+	if info, err = c.controlOpt(o, v); err != nil {
+		return info, err
 	}
-	v := reflect.MakeSlice(reflect.SliceOf(t), 0, n)
-	for i := 0; i < n; i++ {
-		v = reflect.Append(v, reflect.ValueOf(readArrayAt(p, i, t)))
+	if c.values != nil {
+		delete(c.values, o.Index)
 	}
-	return v.Interface()
+	if info.ReloadOpts {
+		c.options = nil // cached options are no longer valid
+		c.deps = nil    // nor are dependencies, found with the old settings
+		if c.values != nil {
+			c.values = map[int]interface{}{}
+		}
+		if c.changeHook != nil {
+			if changed := changedOptions(before, c.optionStates()); len(changed) > 0 {
+				c.changeHook(changed)
+			}
+		}
+	}
+	return info, nil
 }
 
-// GetOption gets the current value for the named option. If successful, it
-// returns a value of the appropriate type for the option.
-func (c *Conn) GetOption(name string) (interface{}, error) {
-	var p unsafe.Pointer
-	for _, o := range c.Options() {
-		if o.Name == name {
-			if o.size > 0 {
-				p = unsafe.Pointer(&make([]byte, o.size)[0])
-			}
-			s := C.sane_control_option(c.handle, C.SANE_Int(o.index),
-				C.SANE_ACTION_GET_VALUE, p, nil)
-			if s != C.SANE_STATUS_GOOD {
-				return nil, mkError(s)
+func toFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// nearest returns the value closest to v that satisfies the constraints of o.
+func nearest(o *Option, v float64) float64 {
+	if o.ConstrRange != nil {
+		min := toFloat(o.ConstrRange.Min)
+		max := toFloat(o.ConstrRange.Max)
+		v = math.Max(min, math.Min(max, v))
+		if q := toFloat(o.ConstrRange.Quant); q > 0 {
+			n := math.Floor((v-min)/q + 0.5)
+			if min+n*q > max {
+				n-- // max is off the grid; snap down to stay in range
 			}
-			switch o.Type {
-			case TypeBool:
-				return readArray(p, boolType, o.Length), nil
-			case TypeInt:
-				return readArray(p, intType, o.Length), nil
-			case TypeFloat:
-				return readArray(p, floatType, o.Length), nil
-			case TypeString:
-				return C.GoString(strFromSane(C.SANE_String_Const(p))), nil
+			v = min + n*q
+		}
+		return v
+	}
+	if len(o.ConstrSet) > 0 {
+		best := toFloat(o.ConstrSet[0])
+		for _, c := range o.ConstrSet[1:] {
+			if x := toFloat(c); math.Abs(x-v) < math.Abs(best-v) {
+				best = x
 			}
 		}
+		return best
 	}
-	return nil, fmt.Errorf("no option named %s", name)
+	return v
 }
 
-func fillOpt(o Option, v interface{}) (unsafe.Pointer, error) {
-	b := make([]byte, o.size)
-	p := unsafe.Pointer(&b[0])
-	l := o.size / int(wordSize)
-
-	s := ""
-	if l > 1 {
-		s = "[]"
+// SetOptionNearest sets the named int or float option to the allowed value
+// closest to val, respecting range quantization and word lists. It returns
+// the value actually applied by the device.
+func (c *Conn) SetOptionNearest(name string, val float64) (float64, Info, error) {
+	o := findOpt(c.Options(), name)
+	if o == nil {
+		return 0, Info{}, fmt.Errorf("no option named %s", name)
 	}
-
+	var v interface{}
 	switch o.Type {
-	case TypeBool:
-		if !writeArray(p, boolType, l, v) {
-			return nil, fmt.Errorf("option %s expects %sbool arg", o.Name, s)
-		}
 	case TypeInt:
-		if !writeArray(p, intType, l, v) {
-			return nil, fmt.Errorf("option %s expects %sint arg", o.Name, s)
-		}
+		v = int(math.Floor(nearest(o, val) + 0.5))
 	case TypeFloat:
-		if !writeArray(p, floatType, l, v) {
-			return nil, fmt.Errorf("option %s expects %sfloat64 arg", o.Name, s)
-		}
-	case TypeString:
-		if _, ok := v.(string); !ok {
-			return nil, fmt.Errorf("option %s expects string arg", o.Name)
+		v = nearest(o, val)
+	default:
+		return 0, Info{}, fmt.Errorf("option %s is not numeric", name)
+	}
+	info, err := c.SetOption(name, v)
+	if err != nil {
+		return 0, info, err
+	}
+	if info.Inexact && o.IsDetectable {
+		// The device adjusted the value further; read it back.
+		if v, err = c.GetOption(name); err != nil {
+			return 0, info, err
 		}
-		copy(b, v.(string))
-		b[len(b)-1] = byte(0) // ensure null terminator when len(s) == len(v)
 	}
+	return toFloat(v), info, nil
+}
 
-	return p, nil
+// SetReadDeadline sets the deadline for reading frame data. Once the deadline
+// passes, Read cancels the current operation and fails with ErrTimeout.
+// A zero value for t means Read will not time out.
+func (c *Conn) SetReadDeadline(t time.Time) {
+	c.deadline = t
 }
 
-func writeArrayAt(p unsafe.Pointer, i int, v reflect.Value) {
-	ptr := (*C.SANE_Word)(p)
-	switch v.Type().Kind() {
-	case reflect.Bool:
-		setNthWord(ptr, i, boolToSane(v.Bool()))
-	case reflect.Int:
-		setNthWord(ptr, i, intToSane(int(v.Int())))
-	case reflect.Float64:
-		setNthWord(ptr, i, floatToSane(v.Float()))
-	}
+// DeviceInfo returns the descriptor of the connected device, as found when
+// devices were last listed before the connection was opened. If the device
+// was not listed, only its name is set.
+func (c *Conn) DeviceInfo() Device {
+	return c.info
 }
 
-func writeArray(p unsafe.Pointer, t reflect.Type, n int, v interface{}) bool {
-	if n == 1 {
-		if reflect.TypeOf(v) != t {
-			return false
-		}
-		writeArrayAt(p, 0, reflect.ValueOf(v))
-	} else {
-		if reflect.TypeOf(v) != reflect.SliceOf(t) {
-			return false
-		}
-		v := reflect.ValueOf(v)
-		if v.Len() != n {
-			return false
-		}
-		for i := 0; i < n; i++ {
-			writeArrayAt(p, i, v.Index(i))
-		}
-	}
-	return true
+// ScanStats holds timing and throughput statistics for a scan.
+type ScanStats struct {
+	BytesRead int64         // total bytes of frame data read
+	Reads     int           // number of reads from the backend
+	ReadTime  time.Duration // time spent blocked in reads
+	StartTime time.Duration // time spent starting frames
+	Pages     int           // number of complete pages read
 }
 
-// SetOption sets the value of the named option, which should be either of the
-// corresponding type, or Auto for automatic mode. If successful, info contains
-// information on the effects of setting the option.
-func (c *Conn) SetOption(name string, v interface{}) (info Info, err error) {
-	var (
-		s C.SANE_Status
-		i C.SANE_Int
-	)
-	for _, o := range c.Options() {
-		if o.Name == name {
-			if _, ok := v.(autoType); ok {
-				// automatic mode
-				s = C.sane_control_option(c.handle, C.SANE_Int(o.index),
-					C.SANE_ACTION_SET_AUTO, nil, &i)
-			} else {
-				p, err := fillOpt(o, v)
-				if err != nil {
-					return info, err
-				}
-				s = C.sane_control_option(c.handle, C.SANE_Int(o.index),
-					C.SANE_ACTION_SET_VALUE, p, &i)
-			}
+func (s *ScanStats) addRead(n int, d time.Duration) {
+	s.BytesRead += int64(n)
+	s.Reads++
+	s.ReadTime += d
+}
 
-			if s != C.SANE_STATUS_GOOD {
-				return info, mkError(s)
-			}
+// Stats returns statistics for the current or last scan, which accumulate
+// across the frames and pages read since the scan was started.
+func (c *Conn) Stats() ScanStats {
+	return c.stats
+}
 
-			if int(i)&C.SANE_INFO_INEXACT != 0 {
-				info.Inexact = true
-			}
-			if int(i)&C.SANE_INFO_RELOAD_OPTIONS != 0 {
-				info.ReloadOpts = true
-				c.options = nil // cached options are no longer valid
-			}
-			if int(i)&C.SANE_INFO_RELOAD_PARAMS != 0 {
-				info.ReloadParams = true
-			}
-			return info, nil
-		}
-	}
-	return info, fmt.Errorf("no option named %s", name)
+// SetReadBufferSize sets the size of the buffer used by ReadFrame and the
+// functions reading whole images to n bytes. Larger buffers need fewer calls
+// into the backend, which may speed up reads from network devices. If n is
+// zero or negative, a buffer holding several lines is used.
+func (c *Conn) SetReadBufferSize(n int) {
+	c.bufSize = n
 }
 
-// Params retrieves the current scanning parameters. The parameters are
-// guaranteed to be accurate between the time the scan is started and the time
-// the request is completed or cancelled. Outside that window, they are
-// best-effort estimates for the next frame.
-func (c *Conn) Params() (Params, error) {
-	var p C.SANE_Parameters
-	if s := C.sane_get_parameters(c.handle, &p); s != C.SANE_STATUS_GOOD {
-		return Params{}, mkError(s)
-	}
-	return Params{
-		Format:        Format(p.format),
-		IsLast:        boolFromSane(C.SANE_Word(p.last_frame)),
-		BytesPerLine:  int(p.bytes_per_line),
-		PixelsPerLine: int(p.pixels_per_line),
-		Lines:         int(p.lines),
-		Depth:         int(p.depth)}, nil
+// A BufferPool provides the byte slices holding frame data. Get returns a
+// slice with a capacity of at least n bytes, and Put takes back a slice that
+// is no longer in use.
+type BufferPool interface {
+	Get(n int) []byte
+	Put([]byte)
 }
 
-// Read reads up to len(b) bytes of data from the current frame.
-// It returns the number of bytes read and an error, if any. If the frame is
-// complete, a zero count is returned together with an io.EOF error.
-func (c *Conn) Read(b []byte) (int, error) {
-	var n C.SANE_Int
-	s := C.sane_read(c.handle, (*C.SANE_Byte)(&b[0]), C.SANE_Int(len(b)), &n)
-	if s == C.SANE_STATUS_EOF {
-		return 0, io.EOF
-	}
-	if s != C.SANE_STATUS_GOOD {
-		return 0, mkError(s)
+// SetBufferPool makes ReadFrame and the functions reading whole images take
+// frame data buffers from pool, which may be nil to allocate them normally.
+// Buffers are returned to the pool by Frame.Release and Image.Release.
+func (c *Conn) SetBufferPool(pool BufferPool) {
+	c.pool = pool
+}
+
+// SetAutoCancel sets whether ReadImage cancels the scan after reading an
+// image, which it does by default. Some backends fully reset the device on
+// cancel, so callers reading several pages from a feeder may disable it to
+// speed up scanning, and must then call Cancel themselves once done. A
+// flatbed scan should always be cancelled before the next one is started.
+func (c *Conn) SetAutoCancel(enabled bool) {
+	c.noCancel = !enabled
+}
+
+// IsMultiFrame reports whether an image scanned with the current parameters
+// will be made up of more than one frame, as in three-pass color scans.
+func (c *Conn) IsMultiFrame() (bool, error) {
+	p, err := c.Params()
+	if err != nil {
+		return false, err
 	}
-	return int(n), nil
+	return p.Format != FrameGray && p.Format != FrameRgb, nil
 }
 
-// Cancel cancels the currently pending operation as soon as possible.
-// It returns immediately; when the actual cancellation occurs, the canceled
-// operation returns with ErrCancelled.
-func (c *Conn) Cancel() {
-	C.sane_cancel(c.handle)
+// Frames returns the number of frames in an image with these parameters:
+// three for three-pass color scans and one otherwise.
+func (p Params) Frames() int {
+	switch p.Format {
+	case FrameRed, FrameGreen, FrameBlue:
+		return 3
+	}
+	return 1
 }
 
-// Close closes the connection, rendering it unusable for further operations.
-func (c *Conn) Close() {
-	C.sane_close(c.handle)
-	c.handle = nil
-	c.options = nil
+// probeSize is the amount of data read by Probe.
+const probeSize = 64
+
+// Probe checks that the device produces data by starting the acquisition of a
+// frame, reading a small amount of it and cancelling. It returns the
+// parameters of the frame.
+func (c *Conn) Probe() (Params, error) {
+	if err := c.Start(); err != nil {
+		return Params{}, err
+	}
+	defer c.Cancel()
+	p, err := c.Params()
+	if err != nil {
+		return Params{}, err
+	}
+	b := make([]byte, probeSize)
+	for n := 0; n == 0; {
+		if n, err = c.Read(b); err == io.EOF {
+			return Params{}, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return Params{}, err
+		}
+	}
+	return p, nil
 }
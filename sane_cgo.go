@@ -0,0 +1,655 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build sane_cgo
+// +build sane_cgo
+
+package sane
+
+// #cgo LDFLAGS: -lsane
+// #include <stdlib.h>
+// #include <sane/sane.h>
+//
+// extern void goAuth(SANE_String_Const, SANE_Char *, SANE_Char *);
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const wordSize = unsafe.Sizeof(C.SANE_Word(0))
+
+// h returns the handle of the connection.
+func (c *Conn) h() C.SANE_Handle {
+	return C.SANE_Handle(c.handle)
+}
+
+// Status codes added in SANE 1.0.20, which older headers lack.
+const (
+	statusWarmingUp = 12
+	statusHwLocked  = 13
+)
+
+// mkError converts a libsane status code to an Error. SANE_STATUS_GOOD maps
+// to nil and SANE_STATUS_EOF to io.EOF.
+func mkError(s C.SANE_Status) Error {
+	switch s {
+	case C.SANE_STATUS_GOOD:
+		return nil
+	case C.SANE_STATUS_EOF:
+		return io.EOF
+	case C.SANE_STATUS_UNSUPPORTED:
+		return ErrUnsupported
+	case C.SANE_STATUS_CANCELLED:
+		return ErrCancelled
+	case C.SANE_STATUS_DEVICE_BUSY:
+		return ErrBusy
+	case C.SANE_STATUS_INVAL:
+		return ErrInvalid
+	case C.SANE_STATUS_JAMMED:
+		return ErrJammed
+	case C.SANE_STATUS_NO_DOCS:
+		return ErrEmpty
+	case C.SANE_STATUS_COVER_OPEN:
+		return ErrCoverOpen
+	case C.SANE_STATUS_IO_ERROR:
+		return ErrIo
+	case C.SANE_STATUS_NO_MEM:
+		return ErrNoMem
+	case C.SANE_STATUS_ACCESS_DENIED:
+		return ErrDenied
+	case statusWarmingUp:
+		return ErrWarmingUp
+	case statusHwLocked:
+		return ErrLocked
+	default:
+		return StatusError(s)
+	}
+}
+
+func boolFromSane(b C.SANE_Word) bool {
+	return b != C.SANE_FALSE
+}
+
+func boolToSane(b bool) C.SANE_Word {
+	if b {
+		return C.SANE_TRUE
+	}
+	return C.SANE_FALSE
+}
+
+func intFromSane(i C.SANE_Word) int {
+	return int(i)
+}
+
+func intToSane(i int) C.SANE_Word {
+	return C.SANE_Word(i)
+}
+
+func strFromSane(s C.SANE_String_Const) *C.char {
+	// Cast necessary on older Go versions.
+	return (*C.char)(unsafe.Pointer(s))
+}
+
+func strToSane(s *C.char) C.SANE_String_Const {
+	// Cast necessary on older Go versions.
+	return C.SANE_String_Const(unsafe.Pointer(s))
+}
+
+func floatFromSane(f C.SANE_Word) float64 {
+	return float64(f) / (1 << C.SANE_FIXED_SCALE_SHIFT)
+}
+
+// floatToSane converts f to the nearest fixed-point value, so that converting
+// a value obtained from floatFromSane gives back the same value.
+func floatToSane(f float64) C.SANE_Word {
+	return C.SANE_Word(math.Floor(f*(1<<C.SANE_FIXED_SCALE_SHIFT) + 0.5))
+}
+
+func nthWord(p *C.SANE_Word, i int) C.SANE_Word {
+	a := (*[1 << 16]C.SANE_Word)(unsafe.Pointer(p))
+	return a[i]
+}
+
+func setNthWord(p *C.SANE_Word, i int, w C.SANE_Word) {
+	a := (*[1 << 16]C.SANE_Word)(unsafe.Pointer(p))
+	a[i] = w
+}
+
+func nthString(p *C.SANE_String_Const, i int) C.SANE_String_Const {
+	a := (*[1 << 16]C.SANE_String_Const)(unsafe.Pointer(p))
+	return a[i]
+}
+
+var (
+	initMu    sync.Mutex // protects initCount and version
+	initCount int        // number of calls to Init without a matching Exit
+	version   C.SANE_Int // version code reported by sane_init
+)
+
+// Init must be called before the package can be used.
+//
+// Calls to Init and Exit are reference-counted, so that independent parts of
+// a program can use the package concurrently: only the first call to Init
+// initializes the library, and only the matching last call to Exit releases
+// it.
+func Init() error {
+	initMu.Lock()
+	defer initMu.Unlock()
+	if initCount == 0 {
+		if s := C.sane_init(&version, C.SANE_Auth_Callback(C.goAuth)); s != C.SANE_STATUS_GOOD {
+			return mkError(s)
+		}
+	}
+	initCount++
+	return nil
+}
+
+//export goAuth
+func goAuth(resource C.SANE_String_Const, user, password *C.SANE_Char) {
+	u, p := credentials(C.GoString(strFromSane(resource)))
+	copyCString(user, u, C.SANE_MAX_USERNAME_LEN)
+	copyCString(password, p, C.SANE_MAX_PASSWORD_LEN)
+}
+
+// copyCString copies s to the C buffer dst of n bytes, truncating it if
+// needed to leave room for the terminating NUL.
+func copyCString(dst *C.SANE_Char, s string, n int) {
+	if len(s) > n-1 {
+		s = s[:n-1]
+	}
+	a := (*[1 << 16]byte)(unsafe.Pointer(dst))
+	copy(a[:n-1], s)
+	a[len(s)] = 0
+}
+
+// Version returns the version of the SANE library. It returns zeros if Init
+// has not been called.
+func Version() (major, minor, build int) {
+	initMu.Lock()
+	v := int(version)
+	initMu.Unlock()
+	return (v >> 24) & 0xff, (v >> 16) & 0xff, v & 0xffff
+}
+
+// Exit undoes a successful call to Init. The last matching call releases all
+// resources in use, cancelling any pending operations and closing any open
+// connections, which must not be in use by other goroutines; the package
+// cannot be used after it returns and before Init is called again. Earlier
+// calls, made while other calls to Init are still unmatched, have no effect.
+func Exit() {
+	initMu.Lock()
+	defer initMu.Unlock()
+	if initCount == 0 {
+		return
+	}
+	if initCount--; initCount == 0 {
+		closeAll()
+		C.sane_exit()
+	}
+}
+
+var (
+	connsMu sync.Mutex         // protects conns
+	conns   = map[*Conn]bool{} // open connections
+)
+
+// closeAll cancels and closes all open connections, since backends may not
+// cope with sane_exit being called while handles are open.
+func closeAll() {
+	connsMu.Lock()
+	open := make([]*Conn, 0, len(conns))
+	for c := range conns {
+		open = append(open, c)
+	}
+	connsMu.Unlock()
+	for _, c := range open {
+		c.Cancel()
+		c.Close()
+	}
+}
+
+func nthDevice(p **C.SANE_Device, i int) *C.SANE_Device {
+	a := (*[1 << 16]*C.SANE_Device)(unsafe.Pointer(p))
+	return a[i]
+}
+
+// devicesMu serializes calls to sane_get_devices, which may outlive
+// DevicesTimeout.
+var devicesMu sync.Mutex
+
+func devices(localOnly bool) (devs []Device, err error) {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	var p **C.SANE_Device
+	saneLocalOnly := boolToSane(localOnly)
+	if s := C.sane_get_devices(&p, saneLocalOnly); s != C.SANE_STATUS_GOOD {
+		return nil, mkError(s)
+	}
+	for i := 0; nthDevice(p, i) != nil; i++ {
+		p := nthDevice(p, i)
+		devs = append(devs, Device{
+			C.GoString(strFromSane(p.name)),
+			C.GoString(strFromSane(p.vendor)),
+			C.GoString(strFromSane(p.model)),
+			C.GoString(strFromSane(p._type)),
+		})
+	}
+	remember(devs)
+	return devs, nil
+}
+
+// Open opens a connection to a device with a given name.
+// The empty string opens the first available device.
+func Open(name string) (*Conn, error) {
+	var h C.SANE_Handle
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	if s := C.sane_open(strToSane(cname), &h); s != C.SANE_STATUS_GOOD {
+		return nil, mkError(s)
+	}
+	c := &Conn{Device: name, handle: unsafe.Pointer(h), info: knownDevice(name)}
+	connsMu.Lock()
+	conns[c] = true
+	connsMu.Unlock()
+	return c, nil
+}
+
+// Start initiates the acquisition of a frame. Starting a new scan, rather
+// than the next frame or page of the current one, resets the statistics
+// returned by Stats.
+func (c *Conn) Start() error {
+	c.mu.Lock()
+	if !c.started {
+		c.stats = ScanStats{} // a new scan
+	}
+	c.mu.Unlock()
+	t := time.Now()
+	s := C.sane_start(c.h())
+	c.stats.StartTime += time.Since(t)
+	if s == C.SANE_STATUS_EOF {
+		// Some backends report an exhausted feeder this way.
+		return ErrEmpty
+	}
+	if s != C.SANE_STATUS_GOOD {
+		return mkError(s)
+	}
+	c.mu.Lock()
+	c.started = true
+	c.mu.Unlock()
+	return nil
+}
+
+func parseRangeConstr(d *C.SANE_Option_Descriptor, o *Option) {
+	r := *(**C.SANE_Range)(unsafe.Pointer(&d.constraint))
+	switch o.Type {
+	case TypeInt:
+		o.ConstrRange = &Range{
+			intFromSane(r.min),
+			intFromSane(r.max),
+			intFromSane(r.quant)}
+	case TypeFloat:
+		o.ConstrRange = &Range{
+			floatFromSane(r.min),
+			floatFromSane(r.max),
+			floatFromSane(r.quant)}
+	}
+}
+
+func parseIntConstr(d *C.SANE_Option_Descriptor, o *Option) {
+	p := *(**C.SANE_Word)(unsafe.Pointer(&d.constraint))
+	n := intFromSane(nthWord(p, 0))
+	// First word is number of remaining words in array.
+	for i := 1; i <= n; i++ {
+		o.ConstrSet = append(o.ConstrSet, intFromSane(nthWord(p, i)))
+	}
+}
+
+func parseFloatConstr(d *C.SANE_Option_Descriptor, o *Option) {
+	p := *(**C.SANE_Word)(unsafe.Pointer(&d.constraint))
+	n := intFromSane(nthWord(p, 0))
+	// First word is number of remaining words in array.
+	for i := 1; i <= n; i++ {
+		o.ConstrSet = append(o.ConstrSet, floatFromSane(nthWord(p, i)))
+	}
+}
+
+func parseStrConstr(d *C.SANE_Option_Descriptor, o *Option) {
+	p := *(**C.SANE_String_Const)(unsafe.Pointer(&d.constraint))
+	// Array is null-terminated.
+	for i := 0; nthString(p, i) != nil; i++ {
+		s := C.GoString(strFromSane(nthString(p, i)))
+		o.ConstrSet = append(o.ConstrSet, s)
+	}
+}
+
+func parseOpt(d *C.SANE_Option_Descriptor) (o Option) {
+	o.Name = C.GoString(strFromSane(d.name))
+	o.Title = C.GoString(strFromSane(d.title))
+	o.Desc = C.GoString(strFromSane(d.desc))
+	o.Type = Type(d._type)
+	o.Unit = Unit(d.unit)
+	o.size = int(d.size)
+	if o.Type == TypeInt || o.Type == TypeFloat {
+		o.Length = o.size / int(wordSize)
+	} else {
+		o.Length = 1
+	}
+	switch d.constraint_type {
+	case C.SANE_CONSTRAINT_RANGE:
+		parseRangeConstr(d, &o)
+	case C.SANE_CONSTRAINT_WORD_LIST:
+		if o.Type == TypeInt {
+			parseIntConstr(d, &o)
+		} else {
+			parseFloatConstr(d, &o)
+		}
+	case C.SANE_CONSTRAINT_STRING_LIST:
+		parseStrConstr(d, &o)
+	}
+	o.IsActive = (d.cap & C.SANE_CAP_INACTIVE) == 0
+	o.IsSettable = (d.cap & C.SANE_CAP_SOFT_SELECT) != 0
+	o.IsDetectable = (d.cap & C.SANE_CAP_SOFT_DETECT) != 0
+	o.IsAutomatic = (d.cap & C.SANE_CAP_AUTOMATIC) != 0
+	o.IsEmulated = (d.cap & C.SANE_CAP_EMULATED) != 0
+	o.IsAdvanced = (d.cap & C.SANE_CAP_ADVANCED) != 0
+	return
+}
+
+// Options returns a list of available scanning options.
+// The list of options usually remains valid until the connection is closed,
+// but setting some options may affect the value or availability of others.
+func (c *Conn) Options() (opts []Option) {
+	if c.options != nil {
+		return c.options // use cached value
+	}
+	curgroup := ""
+	for i := 1; ; i++ {
+		desc := C.sane_get_option_descriptor(c.h(), C.SANE_Int(i))
+		if desc == nil {
+			break
+		}
+		opt := parseOpt(desc)
+		if opt.Type == typeGroup {
+			curgroup = opt.Title
+			continue
+		}
+		opt.Group = curgroup
+		opt.Index = i
+		opts = append(opts, opt)
+	}
+	c.options = opts
+	return
+}
+
+func readArrayAt(p unsafe.Pointer, i int, t reflect.Type) interface{} {
+	ptr := (*C.SANE_Word)(p)
+	switch t.Kind() {
+	case reflect.Bool:
+		return boolFromSane(nthWord(ptr, i))
+	case reflect.Int:
+		return intFromSane(nthWord(ptr, i))
+	case reflect.Float64:
+		return floatFromSane(nthWord(ptr, i))
+	default:
+		return nil
+	}
+}
+
+func readArray(p unsafe.Pointer, t reflect.Type, n int) interface{} {
+	if n == 1 {
+		return readArrayAt(p, 0, t)
+	}
+	v := reflect.MakeSlice(reflect.SliceOf(t), 0, n)
+	for i := 0; i < n; i++ {
+		v = reflect.Append(v, reflect.ValueOf(readArrayAt(p, i, t)))
+	}
+	return v.Interface()
+}
+
+func (c *Conn) fetchOpt(o *Option) (interface{}, error) {
+	var p unsafe.Pointer
+	if o.size > 0 {
+		p = unsafe.Pointer(&make([]byte, o.size)[0])
+	}
+	s := C.sane_control_option(c.h(), C.SANE_Int(o.Index),
+		C.SANE_ACTION_GET_VALUE, p, nil)
+	if s != C.SANE_STATUS_GOOD {
+		return nil, mkError(s)
+	}
+	switch o.Type {
+	case TypeBool:
+		return readArray(p, boolType, o.Length), nil
+	case TypeInt:
+		return readArray(p, intType, o.Length), nil
+	case TypeFloat:
+		return readArray(p, floatType, o.Length), nil
+	case TypeString:
+		return C.GoString(strFromSane(C.SANE_String_Const(p))), nil
+	}
+	return nil, nil
+}
+
+func fillOpt(o Option, v interface{}) (unsafe.Pointer, error) {
+	if o.Type == TypeButton {
+		return nil, nil // buttons take no value
+	}
+	b := make([]byte, o.size)
+	p := unsafe.Pointer(&b[0])
+	l := o.size / int(wordSize)
+
+	s := ""
+	if l > 1 {
+		s = "[]"
+	}
+
+	switch o.Type {
+	case TypeBool:
+		if !writeArray(p, boolType, l, v) {
+			return nil, fmt.Errorf("option %s expects %sbool arg", o.Name, s)
+		}
+	case TypeInt:
+		if !writeArray(p, intType, l, v) {
+			return nil, fmt.Errorf("option %s expects %sint arg", o.Name, s)
+		}
+	case TypeFloat:
+		if !writeArray(p, floatType, l, v) {
+			return nil, fmt.Errorf("option %s expects %sfloat64 arg", o.Name, s)
+		}
+	case TypeString:
+		if _, ok := v.(string); !ok {
+			return nil, fmt.Errorf("option %s expects string arg", o.Name)
+		}
+		copy(b, v.(string))
+		b[len(b)-1] = byte(0) // ensure null terminator when len(s) == len(v)
+	}
+
+	return p, nil
+}
+
+func writeArrayAt(p unsafe.Pointer, i int, v reflect.Value) {
+	ptr := (*C.SANE_Word)(p)
+	switch v.Type().Kind() {
+	case reflect.Bool:
+		setNthWord(ptr, i, boolToSane(v.Bool()))
+	case reflect.Int:
+		setNthWord(ptr, i, intToSane(int(v.Int())))
+	case reflect.Float64:
+		setNthWord(ptr, i, floatToSane(v.Float()))
+	}
+}
+
+func writeArray(p unsafe.Pointer, t reflect.Type, n int, v interface{}) bool {
+	if n == 1 {
+		if reflect.TypeOf(v) != t {
+			return false
+		}
+		writeArrayAt(p, 0, reflect.ValueOf(v))
+	} else {
+		if reflect.TypeOf(v) != reflect.SliceOf(t) {
+			return false
+		}
+		v := reflect.ValueOf(v)
+		if v.Len() != n {
+			return false
+		}
+		for i := 0; i < n; i++ {
+			writeArrayAt(p, i, v.Index(i))
+		}
+	}
+	return true
+}
+
+// controlOpt sets option o to v, which must have been coerced to the option
+// type, or to its automatic value if v is Auto.
+func (c *Conn) controlOpt(o *Option, v interface{}) (info Info, err error) {
+	var (
+		s C.SANE_Status
+		i C.SANE_Int
+	)
+	if _, ok := v.(autoType); ok {
+		// automatic mode
+		s = C.sane_control_option(c.h(), C.SANE_Int(o.Index),
+			C.SANE_ACTION_SET_AUTO, nil, &i)
+	} else {
+		p, err := fillOpt(*o, v)
+		if err != nil {
+			return info, err
+		}
+		s = C.sane_control_option(c.h(), C.SANE_Int(o.Index),
+			C.SANE_ACTION_SET_VALUE, p, &i)
+	}
+
+	if s != C.SANE_STATUS_GOOD {
+		return info, mkError(s)
+	}
+
+	if int(i)&C.SANE_INFO_INEXACT != 0 {
+		info.Inexact = true
+	}
+	if int(i)&C.SANE_INFO_RELOAD_OPTIONS != 0 {
+		info.ReloadOpts = true
+	}
+	if int(i)&C.SANE_INFO_RELOAD_PARAMS != 0 {
+		info.ReloadParams = true
+	}
+	return info, nil
+}
+
+// Params retrieves the current scanning parameters. The parameters are
+// guaranteed to be accurate between the time the scan is started and the time
+// the request is completed or cancelled. Outside that window, they are
+// best-effort estimates for the next frame.
+func (c *Conn) Params() (Params, error) {
+	var p C.SANE_Parameters
+	if s := C.sane_get_parameters(c.h(), &p); s != C.SANE_STATUS_GOOD {
+		return Params{}, mkError(s)
+	}
+	return Params{
+		Format:        Format(p.format),
+		IsLast:        boolFromSane(C.SANE_Word(p.last_frame)),
+		BytesPerLine:  int(p.bytes_per_line),
+		PixelsPerLine: int(p.pixels_per_line),
+		Lines:         int(p.lines),
+		Depth:         int(p.depth)}, nil
+}
+
+// Read reads up to len(b) bytes of data from the current frame.
+// It returns the number of bytes read and an error, if any. If the frame is
+// complete, a zero count is returned together with an io.EOF error.
+func (c *Conn) Read(b []byte) (int, error) {
+	if !c.deadline.IsZero() && time.Now().After(c.deadline) {
+		c.Cancel()
+		return 0, ErrTimeout
+	}
+	var n C.SANE_Int
+	t := time.Now()
+	s := C.sane_read(c.h(), (*C.SANE_Byte)(&b[0]), C.SANE_Int(len(b)), &n)
+	c.stats.addRead(int(n), time.Since(t))
+	if s == C.SANE_STATUS_EOF {
+		if p, err := c.Params(); err == nil && p.IsLast {
+			c.stats.Pages++
+		}
+		return 0, io.EOF
+	}
+	if s != C.SANE_STATUS_GOOD {
+		return 0, mkError(s)
+	}
+	return int(n), nil
+}
+
+// SetNonBlocking sets whether Read returns immediately with a zero count,
+// rather than blocking, when no data is available. It must be called after
+// Start. Many backends do not support non-blocking reads, in which case it
+// returns ErrUnsupported.
+func (c *Conn) SetNonBlocking(nb bool) error {
+	if s := C.sane_set_io_mode(c.h(), boolToSane(nb)); s != C.SANE_STATUS_GOOD {
+		return mkError(s)
+	}
+	return nil
+}
+
+// SelectFD returns a file descriptor that becomes readable when data is
+// available for Read, for use with select or poll. It must be called after
+// Start, and the descriptor must only be used for waiting. Many backends do
+// not provide one, in which case it returns ErrUnsupported.
+func (c *Conn) SelectFD() (int, error) {
+	var fd C.SANE_Int
+	if s := C.sane_get_select_fd(c.h(), &fd); s != C.SANE_STATUS_GOOD {
+		return -1, mkError(s)
+	}
+	return int(fd), nil
+}
+
+// Cancel cancels the currently pending operation as soon as possible.
+// It returns immediately; when the actual cancellation occurs, the canceled
+// operation returns with ErrCancelled. It may be called from another
+// goroutine while a read is in progress. It is a no-op if the connection is
+// closed.
+func (c *Conn) Cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handle == nil {
+		return
+	}
+	C.sane_cancel(c.h())
+	c.started = false
+	c.done = false
+}
+
+// abort cancels the pending operation like Cancel, but without updating the
+// connection state, so that it can be called while another goroutine is
+// reading. The reading goroutine must call Cancel afterwards.
+func (c *Conn) abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handle != nil {
+		C.sane_cancel(c.h())
+	}
+}
+
+// Close closes the connection, rendering it unusable for further operations.
+// Closing an already closed connection has no effect.
+func (c *Conn) Close() {
+	c.mu.Lock()
+	if c.handle == nil {
+		c.mu.Unlock()
+		return
+	}
+	C.sane_close(c.h())
+	c.handle = nil
+	c.started = false
+	c.done = false
+	c.mu.Unlock()
+	connsMu.Lock()
+	delete(conns, c)
+	connsMu.Unlock()
+	c.options = nil
+}
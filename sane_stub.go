@@ -0,0 +1,84 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !sane_cgo
+// +build !sane_cgo
+
+package sane
+
+// This file stands in for the libsane bindings when building without the
+// sane_cgo tag. Images and frames can still be processed, but no device can
+// be opened: device functions fail with ErrUnsupported.
+
+// Init must be called before the package can be used. Without libsane, it
+// always fails with ErrUnsupported.
+func Init() error {
+	return ErrUnsupported
+}
+
+// Version returns the version of the SANE library, or zeros without libsane.
+func Version() (major, minor, build int) {
+	return 0, 0, 0
+}
+
+// Exit undoes a successful call to Init. Without libsane, Init never
+// succeeds, so Exit does nothing.
+func Exit() {}
+
+func devices(localOnly bool) ([]Device, error) {
+	return nil, ErrUnsupported
+}
+
+// Open opens a connection to a device with a given name. Without libsane, it
+// always fails with ErrUnsupported.
+func Open(name string) (*Conn, error) {
+	return nil, ErrUnsupported
+}
+
+// Start initiates the acquisition of a frame.
+func (c *Conn) Start() error {
+	return ErrUnsupported
+}
+
+// Options returns a list of available scanning options.
+func (c *Conn) Options() []Option {
+	return nil
+}
+
+func (c *Conn) fetchOpt(o *Option) (interface{}, error) {
+	return nil, ErrUnsupported
+}
+
+func (c *Conn) controlOpt(o *Option, v interface{}) (Info, error) {
+	return Info{}, ErrUnsupported
+}
+
+// Params retrieves the current scanning parameters.
+func (c *Conn) Params() (Params, error) {
+	return Params{}, ErrUnsupported
+}
+
+// Read reads up to len(b) bytes of data from the current frame.
+func (c *Conn) Read(b []byte) (int, error) {
+	return 0, ErrUnsupported
+}
+
+// SetNonBlocking sets whether Read blocks when no data is available.
+func (c *Conn) SetNonBlocking(nb bool) error {
+	return ErrUnsupported
+}
+
+// SelectFD returns a file descriptor that becomes readable when data is
+// available for Read.
+func (c *Conn) SelectFD() (int, error) {
+	return -1, ErrUnsupported
+}
+
+// Cancel cancels the currently pending operation as soon as possible.
+func (c *Conn) Cancel() {}
+
+func (c *Conn) abort() {}
+
+// Close closes the connection, rendering it unusable for further operations.
+func (c *Conn) Close() {}
@@ -2,13 +2,27 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+//go:build sane_cgo
+// +build sane_cgo
+
 package sane
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"image"
 	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
 	"reflect"
 	"testing"
+	"time"
 )
 
 const TestDevice = "test" // the sane test device
@@ -20,40 +34,6 @@ var not = map[bool]string{
 	false: "not ",
 }
 
-var typeMap = map[Type]string{
-	TypeBool:   "bool",
-	TypeInt:    "int",
-	TypeFloat:  "float",
-	TypeString: "string",
-	TypeButton: "button",
-}
-
-func typeName(t Type) string {
-	s, ok := typeMap[t]
-	if ok {
-		return s
-	}
-	return fmt.Sprintf("(unknown type with value %d)", int(t))
-}
-
-var unitMap = map[Unit]string{
-	UnitNone:    "none",
-	UnitPixel:   "pixel",
-	UnitBit:     "bit",
-	UnitMm:      "mm",
-	UnitDpi:     "dpi",
-	UnitPercent: "percent",
-	UnitUsec:    "milliseconds",
-}
-
-func unitName(u Unit) string {
-	s, ok := unitMap[u]
-	if ok {
-		return s
-	}
-	return fmt.Sprintf("(unknown unit with value %d)", int(u))
-}
-
 // Test options provided by the sane test device.
 var testOpts = []Option{
 	{
@@ -254,11 +234,11 @@ func checkOption(t *testing.T, actual, expected *Option) {
 	}
 	if actual.Type != expected.Type {
 		t.Errorf("option %s has wrong type: %s should be %s",
-			actual.Name, typeName(actual.Type), typeName(expected.Type))
+			actual.Name, actual.Type, expected.Type)
 	}
 	if actual.Unit != expected.Unit {
 		t.Errorf("option %s has wrong unit: %s should be %s",
-			actual.Name, unitName(actual.Unit), unitName(expected.Unit))
+			actual.Name, actual.Unit, expected.Unit)
 	}
 	if actual.Length != expected.Length {
 		t.Errorf("option %s has wrong length: %d should be %d",
@@ -318,7 +298,7 @@ func checkOptionType(t *testing.T, o *Option, val interface{}) {
 	}
 	if !ok {
 		t.Errorf("get option %s returned %s, should return %s",
-			o.Name, valType, typeName(o.Type))
+			o.Name, valType, o.Type)
 	}
 }
 
@@ -577,6 +557,47 @@ func runColorTest(t *testing.T, depth int, n int, f func(i int, c *Conn)) {
 	})
 }
 
+func TestVersion(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		if major, _, _ := Version(); major != 1 {
+			t.Fatalf("bad major version: %d should be 1", major)
+		}
+	})
+}
+
+func TestExitCloses(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal("init failed:", err)
+	}
+	c, err := Open(TestDevice)
+	if err != nil {
+		Exit()
+		t.Fatal("open failed:", err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal("start failed:", err)
+	}
+	Exit()
+	if c.handle != nil || c.started {
+		t.Fatal("connection still open after exit")
+	}
+	c.Close() // must not crash
+}
+
+func TestNestedInit(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal("init failed:", err)
+	}
+	runTest(t, 1, nil) // inner Init and Exit
+	defer Exit()
+	c, err := Open(TestDevice)
+	if err != nil {
+		t.Fatal("open after nested exit failed:", err)
+	}
+	defer c.Close()
+	readImage(t, c)
+}
+
 func TestDevices(t *testing.T) {
 	// Devices may be slow querying the network for available devices.
 	if testing.Short() {
@@ -591,6 +612,80 @@ func TestDevices(t *testing.T) {
 	}
 }
 
+func TestDeviceInfo(t *testing.T) {
+	remember([]Device{{"fake:1", "Vendor", "Model", "flatbed scanner"}})
+	if d := knownDevice("fake:1"); d.Vendor != "Vendor" || d.Model != "Model" {
+		t.Errorf("bad listed device: %+v", d)
+	}
+	if d := knownDevice("fake:2"); d != (Device{Name: "fake:2"}) {
+		t.Errorf("bad unlisted device: %+v", d)
+	}
+	runTest(t, 1, func(i int, c *Conn) {
+		if d := c.DeviceInfo(); d.Name != TestDevice {
+			t.Errorf("device has name %s, should be %s", d.Name, TestDevice)
+		}
+	})
+}
+
+func TestStrings(t *testing.T) {
+	strs := []struct {
+		v   fmt.Stringer
+		exp string
+	}{
+		{TypeBool, "bool"},
+		{TypeFloat, "float"},
+		{Type(42), "Type(42)"},
+		{UnitMm, "mm"},
+		{UnitUsec, "usec"},
+		{FrameRgb, "rgb"},
+		{FrameBlue, "blue"},
+	}
+	for _, s := range strs {
+		if s.v.String() != s.exp {
+			t.Errorf("bad string: %s should be %s", s.v.String(), s.exp)
+		}
+	}
+}
+
+func TestDeviceBackend(t *testing.T) {
+	devs := []struct {
+		name    string
+		backend string
+		network bool
+	}{
+		{"test", "test", false},
+		{"test:0", "test", false},
+		{"genesys:libusb:001:002", "genesys", false},
+		{"net:host:test:0", "test", true},
+		{"net:[::1]:genesys:libusb:001:002", "genesys", true},
+		{"net:host", "", true},
+	}
+	for _, d := range devs {
+		dev := Device{Name: d.name}
+		if b := dev.Backend(); b != d.backend {
+			t.Errorf("device %s has wrong backend: %s should be %s",
+				d.name, b, d.backend)
+		}
+		if dev.IsNetwork() != d.network {
+			t.Errorf("device %s should %sbe a network device",
+				d.name, not[d.network])
+		}
+	}
+}
+
+func TestDevicesTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	if err := Init(); err != nil {
+		t.Fatal("init failed:", err)
+	}
+	defer Exit()
+	if _, err := DevicesTimeout(time.Minute); err != nil {
+		t.Fatal("list devices failed:", err)
+	}
+}
+
 func TestListOptions(t *testing.T) {
 	runTest(t, 1, func(i int, c *Conn) {
 		opts := c.Options()
@@ -635,162 +730,2308 @@ func TestSetOptions(t *testing.T) {
 	})
 }
 
-func TestGray(t *testing.T) {
-	runGrayTest(t, 8, 1, nil)
+func TestIsMultiFrame(t *testing.T) {
+	runTest(t, 2, func(i int, c *Conn) {
+		threePass := i == 1
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "three-pass", threePass)
+		multi, err := c.IsMultiFrame()
+		if err != nil {
+			t.Fatal("is multi frame failed:", err)
+		}
+		if multi != threePass {
+			t.Errorf("scan should %sbe multi-frame", not[threePass])
+		}
+	})
 }
 
-func TestGrayTwice(t *testing.T) {
-	runGrayTest(t, 8, 2, nil)
+func checkSubImage(t *testing.T, m *Image) {
+	r := image.Rect(3, 5, 50, 1<<20) // extends past the bottom edge
+	s := m.SubImage(r)
+	r = r.Intersect(m.Bounds())
+	if b := s.Bounds(); b != image.Rect(0, 0, r.Dx(), r.Dy()) {
+		t.Fatalf("bad sub image bounds: %v for %v", b, r)
+	}
+	for x := 0; x < r.Dx(); x++ {
+		for y := 0; y < r.Dy(); y++ {
+			if s.At(x, y) != m.At(r.Min.X+x, r.Min.Y+y) {
+				t.Fatalf("bad sub image pixel at (%d,%d): %v should be %v",
+					x, y, s.At(x, y), m.At(r.Min.X+x, r.Min.Y+y))
+			}
+		}
+	}
 }
 
-func TestColor(t *testing.T) {
-	runColorTest(t, 8, 1, nil)
+func TestSubImage(t *testing.T) {
+	for _, d := range []int{1, 8, 16} {
+		// Gray, interleaved color and three-pass color.
+		runTest(t, 3, func(i int, c *Conn) {
+			if i == 0 {
+				setOption(t, c, "mode", "Gray")
+			} else {
+				setOption(t, c, "mode", "Color")
+				setOption(t, c, "three-pass", i == 2)
+			}
+			setOption(t, c, "depth", d)
+			setOption(t, c, "test-picture", "Color pattern")
+			setResAndSize(t, c, d)
+			checkSubImage(t, readImage(t, c))
+		})
+	}
 }
 
-func TestColorTwice(t *testing.T) {
-	runColorTest(t, 8, 2, nil)
+func checkMargin(t *testing.T, m *Image, bg color.Color) {
+	const px = 7
+	n := m.WithMargin(px, bg)
+	b, nb := m.Bounds(), n.Bounds()
+	if nb.Dx() != b.Dx()+2*px || nb.Dy() != b.Dy()+2*px {
+		t.Fatalf("bad bounds with margin: %v should be %v wider and taller than %v",
+			nb, 2*px, b)
+	}
+	want := m.ColorModel().Convert(bg)
+	for x := 0; x < nb.Dx(); x++ {
+		for y := 0; y < nb.Dy(); y++ {
+			inner := image.Pt(x-px, y-px).In(b)
+			if !inner && n.At(x, y) != want {
+				t.Fatalf("bad margin pixel at (%d,%d): %v should be %v",
+					x, y, n.At(x, y), want)
+			}
+			if inner && n.At(x, y) != m.At(x-px, y-px) {
+				t.Fatalf("bad pixel at (%d,%d): %v should be %v",
+					x, y, n.At(x, y), m.At(x-px, y-px))
+			}
+		}
+	}
 }
 
-func TestThreePass(t *testing.T) {
-	runColorTest(t, 8, len(threePassOrder), func(i int, c *Conn) {
-		setOption(t, c, "three-pass", true)
-		setOption(t, c, "three-pass-order", threePassOrder[i])
+func TestSetBackground(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Gray")
+		m := readImage(t, c)
+		b := m.Bounds()
+		if v := m.At(b.Max.X, 0); v != color.White {
+			t.Errorf("bad default background: %v", v)
+		}
+		bg := color.RGBA{0x10, 0x20, 0x30, 0xff}
+		m.SetBackground(bg)
+		if v := m.At(-1, b.Max.Y); v != bg {
+			t.Errorf("bad background: %v should be %v", v, bg)
+		}
+		if v := m.SubImage(b).At(-1, -1); v != bg {
+			t.Errorf("background not kept by SubImage: %v", v)
+		}
 	})
 }
 
-func TestHandScanner(t *testing.T) {
+func TestWithMargin(t *testing.T) {
+	runGrayTest(t, 8, 1, func(i int, c *Conn) {
+		checkMargin(t, readImage(t, c), color.Gray{0xFF})
+	})
 	runColorTest(t, 8, 1, func(i int, c *Conn) {
-		setOption(t, c, "hand-scanner", true)
+		checkMargin(t, readImage(t, c), color.RGBA{0x10, 0x20, 0x30, 0xFF})
+	})
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "three-pass", true)
+		setOption(t, c, "depth", 16)
+		checkMargin(t, readImage(t, c), color.RGBA64{0x1000, 0x2000, 0x3000, 0xFFFF})
 	})
 }
 
-func TestPadding(t *testing.T) {
-	runColorTest(t, 8, 1, func(i int, c *Conn) {
-		setOption(t, c, "ppl-loss", 7)
-	})
+func checkRotate(t *testing.T, m *Image) {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	for _, deg := range []int{90, 180, 270} {
+		n, err := m.Rotate(deg)
+		if err != nil {
+			t.Fatalf("rotate by %d failed: %v", deg, err)
+		}
+		if n.ColorModel() != m.ColorModel() {
+			t.Fatalf("rotate by %d changed color model", deg)
+		}
+		nb := n.Bounds()
+		for x := 0; x < nb.Dx(); x++ {
+			for y := 0; y < nb.Dy(); y++ {
+				sx, sy := x, y
+				switch deg {
+				case 90:
+					sx, sy = y, h-1-x
+				case 180:
+					sx, sy = w-1-x, h-1-y
+				case 270:
+					sx, sy = w-1-y, x
+				}
+				if n.At(x, y) != m.At(sx, sy) {
+					t.Fatalf("bad pixel at (%d,%d) rotated by %d: %v should be %v",
+						x, y, deg, n.At(x, y), m.At(sx, sy))
+				}
+			}
+		}
+	}
+	if _, err := m.Rotate(45); err == nil {
+		t.Fatal("rotate by 45 should fail")
+	}
 }
 
-func TestFuzzyParams(t *testing.T) {
-	runColorTest(t, 8, 1, func(i int, c *Conn) {
-		setOption(t, c, "fuzzy-parameters", true)
-	})
+func TestRotate(t *testing.T) {
+	for _, d := range []int{1, 8, 16} {
+		runGrayTest(t, d, 1, func(i int, c *Conn) {
+			checkRotate(t, readImage(t, c))
+		})
+		runColorTest(t, d, 2, func(i int, c *Conn) {
+			setOption(t, c, "three-pass", i == 1)
+			checkRotate(t, readImage(t, c))
+		})
+	}
 }
 
-func TestReadError(t *testing.T) {
-	errList := []struct {
-		s string
-		e Error
-	}{
-		{"SANE_STATUS_UNSUPPORTED", ErrUnsupported},
-		{"SANE_STATUS_CANCELLED", ErrCancelled},
-		{"SANE_STATUS_DEVICE_BUSY", ErrBusy},
-		{"SANE_STATUS_INVAL", ErrInvalid},
-		{"SANE_STATUS_JAMMED", ErrJammed},
-		{"SANE_STATUS_NO_DOCS", ErrEmpty},
-		{"SANE_STATUS_COVER_OPEN", ErrCoverOpen},
-		{"SANE_STATUS_IO_ERROR", ErrIo},
-		{"SANE_STATUS_NO_MEM", ErrNoMem},
-		{"SANE_STATUS_ACCESS_DENIED", ErrDenied},
+func checkFlip(t *testing.T, m *Image) {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	fh, fv := m.FlipH(), m.FlipV()
+	if fh.ColorModel() != m.ColorModel() || fv.ColorModel() != m.ColorModel() {
+		t.Fatal("flip changed color model")
 	}
-	runTest(t, len(errList), func(i int, c *Conn) {
-		setOption(t, c, "read-return-value", errList[i].s)
-		_, err := c.ReadImage()
-		if err != errList[i].e {
-			t.Fatalf("ReadImage returned wrong error: %v should be %v",
-				err, errList[i].e)
+	if fh.Bounds() != b || fv.Bounds() != b {
+		t.Fatal("flip changed bounds")
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if fh.At(x, y) != m.At(w-1-x, y) {
+				t.Fatalf("bad pixel at (%d,%d) flipped horizontally", x, y)
+			}
+			if fv.At(x, y) != m.At(x, h-1-y) {
+				t.Fatalf("bad pixel at (%d,%d) flipped vertically", x, y)
+			}
+		}
+	}
+}
+
+func TestFlip(t *testing.T) {
+	for _, d := range []int{1, 8, 16} {
+		runGrayTest(t, d, 1, func(i int, c *Conn) {
+			checkFlip(t, readImage(t, c))
+		})
+		runColorTest(t, d, 2, func(i int, c *Conn) {
+			setOption(t, c, "three-pass", i == 1)
+			checkFlip(t, readImage(t, c))
+		})
+	}
+}
+
+func TestAutoCrop(t *testing.T) {
+	const px = 5
+	bg := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	for _, d := range []int{8, 16} {
+		runGrayTest(t, d, 1, func(i int, c *Conn) {
+			m := readImage(t, c)
+			n := m.WithMargin(px, bg).AutoCrop(bg, 0.01)
+			if n.Bounds().Dx() > m.Bounds().Dx() || n.Bounds().Dy() > m.Bounds().Dy() {
+				t.Fatalf("margin not cropped: %v should fit in %v",
+					n.Bounds(), m.Bounds())
+			}
+		})
+		runColorTest(t, d, 1, func(i int, c *Conn) {
+			m := readImage(t, c).WithMargin(px, bg)
+			if n := m.AutoCrop(color.Black, 1); !n.Bounds().Empty() {
+				t.Fatalf("full tolerance left bounds %v", n.Bounds())
+			}
+		})
+		// A black image is cropped back to exactly its original bounds.
+		for _, format := range []Format{FrameGray, FrameRgb} {
+			m := &Image{fs: [3]*Frame{makeFrame(format, 10, 6, d)}}
+			n := m.WithMargin(px, bg).AutoCrop(bg, 0.01)
+			if n.Bounds() != m.Bounds() {
+				t.Fatalf("cropped bounds %v should be %v", n.Bounds(), m.Bounds())
+			}
+			for y := 0; y < 6; y++ {
+				for x := 0; x < 10; x++ {
+					if n.At(x, y) != m.At(x, y) {
+						t.Fatalf("cropped image differs at (%d,%d)", x, y)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestFixedRoundTrip(t *testing.T) {
+	const ulp = 1.0 / (1 << 16)
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "enable-test-options", true) // "fixed" is unconstrained
+		for k := 0; k < 1000; k++ {
+			x := float64(k) * 0.0137
+			setOption(t, c, "fixed", x)
+			v := getOption(t, c, "fixed").(float64)
+			if math.Abs(v-x) > ulp/2 {
+				t.Fatalf("fixed set to %v is %v, not the nearest fixed value", x, v)
+			}
+			setOption(t, c, "fixed", v)
+			if w := getOption(t, c, "fixed").(float64); w != v {
+				t.Fatalf("fixed drifted from %v to %v", v, w)
+			}
 		}
 	})
 }
 
-func TestFeeder(t *testing.T) {
-	// Feeder has 10 pages
-	runTest(t, 11, func(i int, c *Conn) {
-		if i == 0 {
-			setOption(t, c, "source", "Automatic Document Feeder")
-			setOption(t, c, "mode", "Color")
-			setOption(t, c, "test-picture", "Color pattern")
+func TestSetOptionCoercion(t *testing.T) {
+	vals := []struct {
+		name string
+		val  interface{}
+		exp  interface{} // nil if setting should fail
+	}{
+		{"int", 2.0, 2},
+		{"int", int32(3), 3},
+		{"int", 2.5, nil},
+		{"fixed", 3, 3.0},
+		{"fixed", float32(0.5), 0.5},
+		{"int-constraint-array", []float64{1, 2, 3, 4, 5, 6}, []int{1, 2, 3, 4, 5, 6}},
+		{"int-constraint-array", []float64{1, 2, 3, 4, 5, 6.5}, nil},
+	}
+	runTest(t, len(vals), func(i int, c *Conn) {
+		setOption(t, c, "enable-test-options", true)
+		v := vals[i]
+		_, err := c.SetOption(v.name, v.val)
+		if v.exp == nil {
+			if err != ErrInvalid {
+				t.Errorf("set option %s to %v returned %v, should be %v",
+					v.name, v.val, err, ErrInvalid)
+			}
+			return
 		}
-		if i < 10 {
-			checkColor(t, readImage(t, c), 8)
-		} else if _, err := c.ReadImage(); err != ErrEmpty {
-			t.Fatalf("feeder not empty after 10 pages")
+		if err != nil {
+			t.Fatalf("set option %s to %v failed: %v", v.name, v.val, err)
+		}
+		if got := getOption(t, c, v.name); !reflect.DeepEqual(got, v.exp) {
+			t.Errorf("get option %s returned wrong value: %v should be %v",
+				v.name, got, v.exp)
 		}
 	})
 }
 
-func TestReadAvailableImages(t *testing.T) {
+func TestOptionByIndex(t *testing.T) {
 	runTest(t, 1, func(i int, c *Conn) {
-		setOption(t, c, "source", "Automatic Document Feeder")
-		setOption(t, c, "mode", "Color")
-		setOption(t, c, "test-picture", "Color pattern")
-		images, err := c.ReadAvailableImages()
+		setOption(t, c, "enable-test-options", true)
+		o := findOption(c.Options(), "int")
+		if o == nil {
+			t.Fatal("option int missing from list")
+		}
+		if _, err := c.SetOptionByIndex(o.Index, 42); err != nil {
+			t.Fatal("set option by index failed:", err)
+		}
+		v, err := c.GetOptionByIndex(o.Index)
 		if err != nil {
-			t.Error("Read available images failed")
+			t.Fatal("get option by index failed:", err)
 		}
-		// Feeder has 10 pages
-		if len(images) != 10 {
-			t.Errorf("Wrong length of images array: %d", len(images))
+		if v != 42 || getOption(t, c, "int") != 42 {
+			t.Fatalf("get option by index returned wrong value: %v should be 42", v)
 		}
-		for _, im := range images {
-			checkColor(t, im, 8)
+		if _, err := c.GetOptionByIndex(-1); err == nil {
+			t.Fatal("get option by bad index should fail")
 		}
 	})
 }
 
-func TestContinuousRead(t *testing.T) {
+func TestOptionLookup(t *testing.T) {
 	runTest(t, 1, func(i int, c *Conn) {
-		setOption(t, c, "source", "Automatic Document Feeder")
-		setOption(t, c, "mode", "Color")
-		setOption(t, c, "test-picture", "Color pattern")
-
-		var cnt = 0
-		err := c.ContinuousRead(func(m *Image) error {
-			checkColor(t, m, 8)
-			cnt++
-			return nil
-		})
-		if err != nil {
-			t.Error("Continuous failed")
+		m := c.OptionMap()
+		if len(m) != len(c.Options()) {
+			t.Fatalf("option map has %d options, should have %d",
+				len(m), len(c.Options()))
 		}
-		// Feeder has 10 pages
-		if cnt != 10 {
-			t.Errorf("Wrong count of processed images: %d", cnt)
+		for _, o := range c.Options() {
+			p, ok := c.Option(o.Name)
+			if !ok || p.Name != o.Name || m[o.Name].Index != o.Index {
+				t.Fatalf("lookup of option %s failed", o.Name)
+			}
+		}
+		if _, ok := c.Option("no-such-option"); ok {
+			t.Fatal("lookup of nonexistent option succeeded")
 		}
 	})
 }
 
-func TestFeederThreePass(t *testing.T) {
-	// Feeder has 10 pages
-	runTest(t, 11, func(i int, c *Conn) {
-		if i == 0 {
-			setOption(t, c, "source", "Automatic Document Feeder")
-			setOption(t, c, "mode", "Color")
-			setOption(t, c, "test-picture", "Color pattern")
-			setOption(t, c, "three-pass", true)
+func TestOptionTitles(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		o, ok := c.Option("tl-x")
+		if !ok {
+			t.Fatal("no tl-x option")
 		}
-		if i < 10 {
-			checkColor(t, readImage(t, c), 8)
-		} else if _, err := c.ReadImage(); err != ErrEmpty {
-			t.Fatalf("feeder not empty after 10 pages")
+		if o.Title == "" || o.Title == o.Name || o.Desc == "" {
+			t.Fatalf("bad title %q or description %q", o.Title, o.Desc)
 		}
 	})
 }
 
-func TestCancel(t *testing.T) {
+func TestSetInterleaved(t *testing.T) {
 	runTest(t, 1, func(i int, c *Conn) {
-		b := make([]byte, 10)
-		if err := c.Start(); err != nil {
-			t.Fatalf("start failed: %v", err)
-		}
-		c.Cancel()
-		_, err := c.Read(b)
-		if err != ErrCancelled {
-			t.Fatalf("read returned wrong error: %v should be %v",
-				err, ErrCancelled)
+		setOption(t, c, "mode", "Color")
+		for _, interleaved := range []bool{false, true} {
+			if err := c.SetInterleaved(interleaved); err != nil {
+				t.Fatal("set interleaved failed:", err)
+			}
+			p, err := c.Params()
+			if err != nil {
+				t.Fatal("params failed:", err)
+			}
+			format, frames := FrameRgb, 1
+			if !interleaved {
+				format, frames = FrameRed, 3
+			}
+			if p.Format != format || p.Frames() != frames {
+				t.Errorf("interleaved %v: format %v with %d frames, should be %v with %d",
+					interleaved, p.Format, p.Frames(), format, frames)
+			}
 		}
 	})
 }
 
+func TestLenientStrings(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		c.SetLenientStrings(true)
+		setOption(t, c, "mode", " color ")
+		if v := getOption(t, c, "mode"); v != "Color" {
+			t.Fatalf("mode is %q, should be Color", v)
+		}
+		if _, err := c.SetOption("mode", "Sepia"); err != ErrInvalid {
+			t.Fatalf("set to unlisted value returned wrong error: %v should be %v",
+				err, ErrInvalid)
+		}
+	})
+}
+
+func TestOptionDependencies(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Color")
+		deps, err := c.OptionDependencies()
+		if err != nil {
+			t.Fatal("option dependencies failed:", err)
+		}
+		if findString(deps["three-pass"], "three-pass-order") < 0 {
+			t.Errorf("three-pass-order missing from three-pass dependencies %v",
+				deps["three-pass"])
+		}
+		if findString(deps["mode"], "three-pass") < 0 {
+			t.Errorf("three-pass missing from mode dependencies %v", deps["mode"])
+		}
+		if v := getOption(t, c, "mode"); v != "Color" {
+			t.Errorf("mode not restored: %v should be Color", v)
+		}
+		// three-pass is inactive in gray mode, so it is no longer probed.
+		setOption(t, c, "mode", "Gray")
+		if deps, err = c.OptionDependencies(); err != nil {
+			t.Fatal("option dependencies failed:", err)
+		}
+		if _, ok := deps["three-pass"]; ok {
+			t.Errorf("stale three-pass dependencies %v", deps["three-pass"])
+		}
+	})
+}
+
+func TestOptionCache(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		c.EnableOptionCache()
+		setOption(t, c, "mode", "Gray")
+		if v := getOption(t, c, "mode"); v != "Gray" {
+			t.Fatalf("mode is %v, should be Gray", v)
+		}
+		setOption(t, c, "mode", "Color")
+		if v := getOption(t, c, "mode"); v != "Color" {
+			t.Fatalf("stale cached mode: %v should be Color", v)
+		}
+		c.InvalidateOptions()
+		if v := getOption(t, c, "mode"); v != "Color" {
+			t.Fatalf("mode is %v after invalidation, should be Color", v)
+		}
+	})
+}
+
+func TestRefresh(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		opts, err := c.Refresh()
+		if err != nil {
+			t.Fatal("refresh failed:", err)
+		}
+		if !reflect.DeepEqual(opts, c.Options()) {
+			t.Fatal("refreshed options differ from Options")
+		}
+	})
+	if err := Init(); err != nil {
+		t.Fatal("init failed:", err)
+	}
+	defer Exit()
+	c, err := Open(TestDevice)
+	if err != nil {
+		t.Fatal("open failed:", err)
+	}
+	c.Close()
+	if _, err := c.Refresh(); err != ErrClosed {
+		t.Fatalf("refresh of closed connection returned wrong error: %v should be %v",
+			err, ErrClosed)
+	}
+}
+
+func TestOptionChangeHook(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Color")
+		var changed []string
+		c.SetOptionChangeHook(func(names []string) {
+			changed = names
+		})
+		setOption(t, c, "three-pass", true)
+		if findString(changed, "three-pass-order") < 0 {
+			t.Fatalf("three-pass-order missing from changed options %v", changed)
+		}
+		if findString(changed, "resolution") >= 0 {
+			t.Fatalf("resolution should not be in changed options %v", changed)
+		}
+	})
+}
+
+func findString(l []string, s string) int {
+	for i, x := range l {
+		if x == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestSources(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		srcs, err := c.Sources()
+		if err != nil {
+			t.Fatal("sources failed:", err)
+		}
+		adf := "Automatic Document Feeder"
+		if findString(srcs, adf) < 0 {
+			t.Fatalf("%s missing from sources %v", adf, srcs)
+		}
+		if err := c.SetSource(adf); err != nil {
+			t.Fatal("set source failed:", err)
+		}
+		if v := getOption(t, c, "source"); v != adf {
+			t.Fatalf("source is %v, should be %s", v, adf)
+		}
+		if err := c.SetSource("Teleporter"); err == nil {
+			t.Fatal("set source to unsupported source should fail")
+		}
+	})
+}
+
+func TestScanArea(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		// The geometry is quantized to whole millimetres; 40x20 mm at 127 dpi
+		// is exactly 200x100 pixels.
+		setOption(t, c, "resolution", 127.0)
+		setOption(t, c, "tl-x", 0.0)
+		setOption(t, c, "tl-y", 0.0)
+		setOption(t, c, "br-x", 40.0)
+		setOption(t, c, "br-y", 20.0)
+		r, err := c.ScanArea()
+		if err != nil {
+			t.Fatal("scan area failed:", err)
+		}
+		if math.Abs(r.Right-40) > 0.01 || math.Abs(r.Bottom-20) > 0.01 {
+			t.Errorf("bad scan area %+v", r)
+		}
+		p, err := c.ScanAreaPixels()
+		if err != nil {
+			t.Fatal("scan area in pixels failed:", err)
+		}
+		if p != image.Rect(0, 0, 200, 100) {
+			t.Errorf("bad scan area in pixels %v", p)
+		}
+	})
+}
+
+func TestConvertGeom(t *testing.T) {
+	dpi := [2]int{100, 200} // separate x and y resolutions
+	for i, exp := range []float64{25.4, 12.7, 25.4, 12.7} {
+		if mm := convertGeom(i, 100, UnitPixel, UnitMm, dpi); math.Abs(mm-exp) > 1e-9 {
+			t.Errorf("%s of 100 px is %v mm, should be %v", geomOpts[i], mm, exp)
+		}
+		if px := convertGeom(i, exp, UnitMm, UnitPixel, dpi); math.Abs(px-100) > 1e-9 {
+			t.Errorf("%s of %v mm is %v px, should be 100", geomOpts[i], exp, px)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		caps := c.Capabilities()
+		if findString(caps.Modes, "Color") < 0 || findString(caps.Modes, "Gray") < 0 {
+			t.Errorf("bad modes %v", caps.Modes)
+		}
+		if findString(caps.Sources, "Flatbed") < 0 {
+			t.Errorf("bad sources %v", caps.Sources)
+		}
+		if caps.MinDPI <= 0 || caps.MaxDPI < caps.MinDPI {
+			t.Errorf("bad resolution range %v-%v", caps.MinDPI, caps.MaxDPI)
+		}
+		if caps.MaxArea.Right <= 0 || caps.MaxArea.Bottom <= 0 {
+			t.Errorf("bad scan area %+v", caps.MaxArea)
+		}
+	})
+}
+
+func TestResolution(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		applied, err := c.SetResolution(150)
+		if err != nil {
+			t.Fatal("set resolution failed:", err)
+		}
+		dpi, err := c.Resolution()
+		if err != nil {
+			t.Fatal("resolution failed:", err)
+		}
+		if applied != 150 || dpi != 150 {
+			t.Fatalf("resolution is %d (applied %d), should be 150", dpi, applied)
+		}
+	})
+}
+
+func TestPressButton(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "enable-test-options", true)
+		if err := c.PressButton("button"); err != nil {
+			t.Fatal("press button failed:", err)
+		}
+		if err := c.PressButton("int"); err == nil {
+			t.Fatal("press button on int option should fail")
+		}
+	})
+}
+
+func TestSetOptionNearest(t *testing.T) {
+	vals := []struct {
+		name    string
+		val     float64
+		applied float64
+	}{
+		{"int-constraint-range", 7.3, 8},
+		{"int-constraint-range", 1000, 192},
+		{"int-constraint-word-list", 20, 17},
+		{"fixed-constraint-word-list", 40, 42},
+	}
+	runTest(t, len(vals), func(i int, c *Conn) {
+		setOption(t, c, "enable-test-options", true)
+		v := vals[i]
+		applied, _, err := c.SetOptionNearest(v.name, v.val)
+		if err != nil {
+			t.Fatalf("set option %s to nearest %v failed: %v", v.name, v.val, err)
+		}
+		if applied != v.applied {
+			t.Errorf("set option %s to nearest %v applied %v, should be %v",
+				v.name, v.val, applied, v.applied)
+		}
+	})
+	// The maximum is off the grid, so values near it snap down.
+	o := &Option{ConstrRange: &Range{Min: 0, Max: 10, Quant: 4}}
+	for _, v := range []float64{9.9, 11, 100} {
+		if n := nearest(o, v); n != 8 {
+			t.Errorf("nearest to %v is %v, should be 8", v, n)
+		}
+	}
+}
+
+func TestImageFormat(t *testing.T) {
+	runTest(t, 3, func(i int, c *Conn) {
+		mode, format := "Gray", FrameGray
+		if i > 0 {
+			mode, format = "Color", FrameRgb
+		}
+		setOption(t, c, "mode", mode)
+		if i > 0 {
+			setOption(t, c, "three-pass", i == 2)
+		}
+		m := readImage(t, c)
+		if f := m.Format(); f != format {
+			t.Errorf("image has format %v, should be %v", f, format)
+		}
+		if p := m.Planar(); p != (i == 2) {
+			t.Errorf("image planar is %v, should be %v", p, i == 2)
+		}
+	})
+}
+
+func TestPlanarRGB(t *testing.T) {
+	runColorTest(t, 8, 1, func(i int, c *Conn) {
+		m := readImage(t, c)
+		r, g, b, stride := m.PlanarRGB()
+		bounds := m.Bounds()
+		for x := 0; x < bounds.Max.X; x++ {
+			for y := 0; y < bounds.Max.Y; y++ {
+				i := stride*y + x
+				p := color.RGBA{r[i], g[i], b[i], 0xFF}
+				if p != m.At(x, y) {
+					t.Fatalf("bad planar pixel at (%d,%d): %v should be %v",
+						x, y, p, m.At(x, y))
+				}
+			}
+		}
+	})
+}
+
+func TestSaturationStats(t *testing.T) {
+	runTest(t, 2, func(i int, c *Conn) {
+		if i == 0 {
+			setOption(t, c, "mode", "Gray")
+		} else {
+			setOption(t, c, "mode", "Color")
+		}
+		setOption(t, c, "test-picture", "Solid white")
+		low, high := readImage(t, c).SaturationStats()
+		if low > 0.01 || high < 0.99 {
+			t.Fatalf("bad saturation stats for white image: low %v, high %v",
+				low, high)
+		}
+	})
+}
+
+func checkPNM(t *testing.T, m *Image, magic string, maxval, bpp int) {
+	var buf bytes.Buffer
+	if err := m.EncodePNM(&buf); err != nil {
+		t.Fatal("encode PNM failed:", err)
+	}
+	b := m.Bounds()
+	header := fmt.Sprintf("%s\n%d %d\n%d\n", magic, b.Dx(), b.Dy(), maxval)
+	if !bytes.HasPrefix(buf.Bytes(), []byte(header)) {
+		t.Fatalf("bad PNM header: %q should start with %q", buf.Bytes()[:20], header)
+	}
+	if n := buf.Len() - len(header); n != b.Dx()*b.Dy()*bpp {
+		t.Fatalf("bad PNM data length: %d should be %d", n, b.Dx()*b.Dy()*bpp)
+	}
+	px := buf.Bytes()[len(header):]
+	c := color.RGBA64Model.Convert(m.At(0, 0)).(color.RGBA64)
+	if bpp == 6 && (px[0] != uint8(c.R>>8) || px[1] != uint8(c.R)) {
+		t.Fatalf("bad PNM first sample: %x should be %x", px[:2], c.R)
+	}
+}
+
+func TestEncodePNM(t *testing.T) {
+	runGrayTest(t, 8, 1, func(i int, c *Conn) {
+		checkPNM(t, readImage(t, c), "P5", 255, 1)
+	})
+	runColorTest(t, 16, 1, func(i int, c *Conn) {
+		checkPNM(t, readImage(t, c), "P6", 65535, 6)
+	})
+	runGrayTest(t, 1, 1, func(i int, c *Conn) {
+		m := readImage(t, c)
+		var buf bytes.Buffer
+		if err := m.EncodePNM(&buf); err != nil {
+			t.Fatal("encode PNM failed:", err)
+		}
+		b := m.Bounds()
+		header := fmt.Sprintf("P4\n%d %d\n", b.Dx(), b.Dy())
+		if !bytes.HasPrefix(buf.Bytes(), []byte(header)) {
+			t.Fatalf("bad PBM header: should start with %q", header)
+		}
+		if n := buf.Len() - len(header); n != (b.Dx()+7)/8*b.Dy() {
+			t.Fatalf("bad PBM data length: %d", n)
+		}
+	})
+}
+
+func checkScanPNM(t *testing.T, c *Conn) {
+	var got, exp bytes.Buffer
+	if err := c.ScanPNM(&got); err != nil {
+		t.Fatal("scan PNM failed:", err)
+	}
+	if err := readImage(t, c).EncodePNM(&exp); err != nil {
+		t.Fatal("encode PNM failed:", err)
+	}
+	if !bytes.Equal(got.Bytes(), exp.Bytes()) {
+		t.Fatal("streamed PNM differs from encoded image")
+	}
+}
+
+func TestScanPNM(t *testing.T) {
+	for _, d := range []int{1, 8, 16} {
+		runGrayTest(t, d, 1, func(i int, c *Conn) {
+			checkScanPNM(t, c)
+		})
+	}
+	for _, d := range []int{8, 16} {
+		runColorTest(t, d, 1, func(i int, c *Conn) {
+			checkScanPNM(t, c)
+		})
+	}
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "three-pass", true)
+		if err := c.ScanPNM(ioutil.Discard); err != ErrNoPNM {
+			t.Fatalf("three-pass scan returned wrong error: %v should be %v",
+				err, ErrNoPNM)
+		}
+	})
+}
+
+func TestHistogram(t *testing.T) {
+	for _, d := range []int{1, 8, 16} {
+		runTest(t, 2, func(i int, c *Conn) {
+			mode, nch := "Gray", 1
+			if i == 1 {
+				mode, nch = "Color", 3
+			}
+			setOption(t, c, "mode", mode)
+			setOption(t, c, "depth", d)
+			m := readImage(t, c)
+			h := m.Histogram()
+			if len(h) != nch {
+				t.Fatalf("%s histogram has %d channels, should be %d",
+					mode, len(h), nch)
+			}
+			b := m.Bounds()
+			for ch := range h {
+				n := 0
+				for _, k := range h[ch] {
+					n += k
+				}
+				if n != b.Dx()*b.Dy() {
+					t.Errorf("channel %d counts %d pixels, should be %d",
+						ch, n, b.Dx()*b.Dy())
+				}
+			}
+		})
+	}
+}
+
+func TestApplyColorMatrix(t *testing.T) {
+	identity := [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	swap := [3][3]float64{{0, 0, 1}, {0, 1, 0}, {1, 0, 0}}
+	for _, d := range []int{8, 16} {
+		// Interleaved and three-pass color.
+		runTest(t, 2, func(i int, c *Conn) {
+			setOption(t, c, "mode", "Color")
+			setOption(t, c, "depth", d)
+			setOption(t, c, "three-pass", i == 1)
+			m := readImage(t, c)
+			id, sw := m.ApplyColorMatrix(identity), m.ApplyColorMatrix(swap)
+			b := m.Bounds()
+			for y := 0; y < b.Dy(); y += 7 {
+				for x := 0; x < b.Dx(); x += 7 {
+					r, g, bl, _ := m.At(x, y).RGBA()
+					if r1, g1, b1, _ := id.At(x, y).RGBA(); r1 != r || g1 != g || b1 != bl {
+						t.Fatalf("identity changed pixel (%d,%d)", x, y)
+					}
+					if r1, g1, b1, _ := sw.At(x, y).RGBA(); r1 != bl || g1 != g || b1 != r {
+						t.Fatalf("swap gave wrong pixel (%d,%d)", x, y)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSwap(t *testing.T) {
+	for _, d := range []int{8, 16} {
+		runColorTest(t, d, 2, func(i int, c *Conn) {
+			setOption(t, c, "three-pass", i == 1)
+			m := readImage(t, c)
+			n, err := m.Swap("BGR")
+			if err != nil {
+				t.Fatal("swap failed:", err)
+			}
+			if n.Planar() != m.Planar() {
+				t.Fatal("swap changed layout")
+			}
+			b := m.Bounds()
+			for y := 0; y < b.Dy(); y += 5 {
+				for x := 0; x < b.Dx(); x += 5 {
+					r, g, bl, _ := m.At(x, y).RGBA()
+					if r1, g1, b1, _ := n.At(x, y).RGBA(); r1 != bl || g1 != g || b1 != r {
+						t.Fatalf("bad swapped pixel at (%d,%d)", x, y)
+					}
+				}
+			}
+		})
+	}
+	runColorTest(t, 8, 1, func(i int, c *Conn) {
+		m := readImage(t, c)
+		for _, order := range []string{"", "RGBA", "RRB", "rgb"} {
+			if _, err := m.Swap(order); err == nil {
+				t.Errorf("swap to %q should fail", order)
+			}
+		}
+	})
+}
+
+func TestIsBlank(t *testing.T) {
+	pics := []struct {
+		pic   string
+		mode  string
+		depth int
+		blank bool
+	}{
+		{"Solid white", "Gray", 8, true},
+		{"Solid white", "Color", 16, true},
+		{"Solid white", "Gray", 1, true},
+		{"Solid black", "Gray", 8, false},
+		{"Color pattern", "Color", 8, false},
+		{"Grid", "Gray", 1, false},
+	}
+	runTest(t, len(pics), func(i int, c *Conn) {
+		p := pics[i]
+		setOption(t, c, "mode", p.mode)
+		setOption(t, c, "depth", p.depth)
+		setOption(t, c, "test-picture", p.pic)
+		if readImage(t, c).IsBlank(0.01) != p.blank {
+			t.Errorf("%d-bit %s %s image should %sbe blank",
+				p.depth, p.mode, p.pic, not[p.blank])
+		}
+	})
+}
+
+func TestStdImage(t *testing.T) {
+	for _, d := range []int{1, 8, 16} {
+		runTest(t, 2, func(i int, c *Conn) {
+			mode := "Gray"
+			if i == 1 {
+				mode = "Color"
+			}
+			setOption(t, c, "mode", mode)
+			setOption(t, c, "depth", d)
+			m := readImage(t, c)
+			n := m.StdImage()
+			b := m.Bounds()
+			if n.Bounds() != b {
+				t.Fatalf("bad bounds %v, should be %v", n.Bounds(), b)
+			}
+			for y := 0; y < b.Dy(); y += 3 {
+				for x := 0; x < b.Dx(); x += 3 {
+					r, g, bl, a := m.At(x, y).RGBA()
+					r1, g1, b1, a1 := n.At(x, y).RGBA()
+					if r != r1 || g != g1 || bl != b1 || a != a1 {
+						t.Fatalf("%d-bit %s pixel (%d,%d) changed", d, mode, x, y)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadImageInto(t *testing.T) {
+	runColorTest(t, 8, 1, func(i int, c *Conn) {
+		p, err := c.Params()
+		if err != nil {
+			t.Fatal("params failed:", err)
+		}
+		dst := image.NewRGBA(image.Rect(10, 20, 10+p.PixelsPerLine, 20+p.Lines))
+		if err := c.ReadImageInto(dst); err != nil {
+			t.Fatal("read image into failed:", err)
+		}
+		if c.pool != nil || len(c.scratch.bufs) == 0 {
+			t.Fatal("frame buffer not kept for the next scan")
+		}
+		m := readImage(t, c)
+		for y := 0; y < p.Lines; y += 5 {
+			for x := 0; x < p.PixelsPerLine; x += 5 {
+				if dst.At(10+x, 20+y) != m.At(x, y) {
+					t.Fatalf("bad pixel at (%d,%d)", x, y)
+				}
+			}
+		}
+		small := image.NewRGBA(image.Rect(0, 0, p.PixelsPerLine-1, p.Lines))
+		if err := c.ReadImageInto(small); err == nil {
+			t.Fatal("read into mismatched image should fail")
+		}
+	})
+}
+
+func checkConvert(t *testing.T, m *Image) {
+	rgba, nrgba64 := m.ToRGBA(), m.ToNRGBA64()
+	gray, gray16 := m.ToGray(), m.ToGray16()
+	b := m.Bounds()
+	for x := 0; x < b.Max.X; x++ {
+		for y := 0; y < b.Max.Y; y++ {
+			c := m.At(x, y)
+			checks := []struct {
+				name     string
+				got, exp color.Color
+			}{
+				{"rgba", rgba.At(x, y), color.RGBAModel.Convert(c)},
+				{"nrgba64", nrgba64.At(x, y), color.NRGBA64Model.Convert(c)},
+				{"gray", gray.At(x, y), color.GrayModel.Convert(c)},
+				{"gray16", gray16.At(x, y), color.Gray16Model.Convert(c)},
+			}
+			for _, ch := range checks {
+				if ch.got != ch.exp {
+					t.Fatalf("bad %s pixel at (%d,%d): %v should be %v",
+						ch.name, x, y, ch.got, ch.exp)
+				}
+			}
+		}
+	}
+}
+
+func checkRow(t *testing.T, m *Image) {
+	b := m.Bounds()
+	row := make([]color.Color, b.Dx()+1)
+	for y := 0; y < b.Dy(); y++ {
+		if n := m.Row(y, row); n != b.Dx() {
+			t.Fatalf("row %d has %d pixels, should have %d", y, n, b.Dx())
+		}
+		for x := 0; x < b.Dx(); x++ {
+			if row[x] != m.At(x, y) {
+				t.Fatalf("bad pixel at (%d,%d): %v should be %v",
+					x, y, row[x], m.At(x, y))
+			}
+		}
+	}
+	if n := m.Row(b.Dy(), row); n != 0 {
+		t.Fatalf("out of bounds row has %d pixels", n)
+	}
+}
+
+func checkNormalized(t *testing.T, m *Image, d int) {
+	if exp := uint32(1)<<uint(d) - 1; m.MaxSample() != exp {
+		t.Fatalf("max sample is %d, should be %d", m.MaxSample(), exp)
+	}
+	b := m.Bounds()
+	for y := 0; y < b.Dy(); y += 3 {
+		for x := 0; x < b.Dx(); x += 3 {
+			r, g, bl, _ := m.At(x, y).RGBA()
+			nr, ng, nb, _ := m.NormalizedAt(x, y).RGBA()
+			if r != nr || g != ng || bl != nb {
+				t.Fatalf("bad normalized pixel at (%d,%d)", x, y)
+			}
+		}
+	}
+}
+
+func TestNormalizedAt(t *testing.T) {
+	for _, d := range []int{1, 8, 16} {
+		runGrayTest(t, d, 1, func(i int, c *Conn) {
+			checkNormalized(t, readImage(t, c), d)
+		})
+		runColorTest(t, d, 1, func(i int, c *Conn) {
+			checkNormalized(t, readImage(t, c), d)
+		})
+	}
+}
+
+func TestRow(t *testing.T) {
+	for _, d := range []int{1, 8, 16} {
+		runGrayTest(t, d, 1, func(i int, c *Conn) {
+			checkRow(t, readImage(t, c))
+		})
+		runColorTest(t, d, 1, func(i int, c *Conn) {
+			checkRow(t, readImage(t, c))
+		})
+	}
+}
+
+func TestConvert(t *testing.T) {
+	for _, d := range []int{1, 8, 16} {
+		runGrayTest(t, d, 1, func(i int, c *Conn) {
+			checkConvert(t, readImage(t, c))
+		})
+		runColorTest(t, d, 1, func(i int, c *Conn) {
+			checkConvert(t, readImage(t, c))
+		})
+	}
+}
+
+func TestBytes16(t *testing.T) {
+	runGrayTest(t, 16, 1, func(i int, c *Conn) {
+		m := readImage(t, c)
+		if !bytes.Equal(m.Gray16Bytes(), m.ToGray16().Pix) {
+			t.Error("Gray16Bytes differs from ToGray16")
+		}
+		if m.RGB48Bytes() != nil {
+			t.Error("RGB48Bytes should be nil for gray images")
+		}
+	})
+	runColorTest(t, 16, 1, func(i int, c *Conn) {
+		m := readImage(t, c)
+		pix := m.ToNRGBA64().Pix
+		var exp []byte
+		for j := 0; j < len(pix); j += 8 {
+			exp = append(exp, pix[j:j+6]...)
+		}
+		if !bytes.Equal(m.RGB48Bytes(), exp) {
+			t.Error("RGB48Bytes differs from ToNRGBA64")
+		}
+		if m.Gray16Bytes() != nil {
+			t.Error("Gray16Bytes should be nil for color images")
+		}
+	})
+}
+
+func TestAdjustBrightnessContrast(t *testing.T) {
+	for _, d := range []int{1, 8, 16} {
+		runColorTest(t, d, 1, func(i int, c *Conn) {
+			m := readImage(t, c)
+			n := m.AdjustBrightnessContrast(0, 0)
+			if d == 1 {
+				if n.MaxSample() != 0xff {
+					t.Fatalf("bilevel image adjusted to depth %d", n.fs[0].Depth)
+				}
+			} else {
+				checkColor(t, n, d)
+			}
+			// Flat mid gray, brightened to white.
+			flat := m.AdjustBrightnessContrast(0.5, -1)
+			b := m.Bounds()
+			max := flat.MaxSample()
+			for y := 0; y < b.Dy(); y += 3 {
+				for x := 0; x < b.Dx(); x += 3 {
+					if s := flat.sampleAt(x, y, 1); uint32(s) != max {
+						t.Fatalf("sample at (%d,%d) is %d, should be %d", x, y, s, max)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	runGrayTest(t, 8, 1, func(i int, c *Conn) {
+		m := readImage(t, c)
+		n := m.Threshold(0x80)
+		checkThreshold(t, m, n, 0x80)
+		n, level := m.ThresholdAuto()
+		checkThreshold(t, m, n, level)
+	})
+}
+
+func checkThreshold(t *testing.T, m, n *Image, level uint8) {
+	if n.ColorModel() != color.GrayModel || n.Bounds() != m.Bounds() {
+		t.Fatalf("bad thresholded image: %v %v", n.ColorModel(), n.Bounds())
+	}
+	b := m.Bounds()
+	for x := 0; x < b.Max.X; x++ {
+		for y := 0; y < b.Max.Y; y++ {
+			exp := color.Gray{0x00}
+			if m.At(x, y).(color.Gray).Y >= level {
+				exp = color.Gray{0xFF}
+			}
+			if n.At(x, y) != exp {
+				t.Fatalf("bad pixel at (%d,%d) with level %d: %v should be %v",
+					x, y, level, n.At(x, y), exp)
+			}
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "test-picture", "Color pattern")
+		setResAndSize(t, c, 8)
+		m := readImage(t, c)
+		b := m.Bounds()
+		n := m.ResizeDPI(200, 100)
+		if nb := n.Bounds(); nb.Dx() != b.Dx()/2 || nb.Dy() != b.Dy()/2 {
+			t.Fatalf("bad resized bounds: %v should be half of %v", nb, b)
+		}
+		if n.ColorModel() != m.ColorModel() {
+			t.Fatalf("resize changed color model")
+		}
+		if m.ResizeDPI(0, 100) != m || m.ResizeDPI(200, -1) != m {
+			t.Fatalf("resize with unknown resolution should return the image")
+		}
+		// The interior of the 4x4 areas is uniform, so the average of
+		// any 2x2 block within one should match.
+		if n.At(3, 3) != m.At(6, 6) {
+			t.Fatalf("bad resized pixel: %v should be %v", n.At(3, 3), m.At(6, 6))
+		}
+	})
+	runGrayTest(t, 1, 1, func(i int, c *Conn) {
+		n := readImage(t, c).Resize(10, 10)
+		if n.ColorModel() != color.GrayModel || n.Bounds().Dx() != 10 {
+			t.Fatal("bad resized bitmap")
+		}
+	})
+}
+
+func TestFrames(t *testing.T) {
+	runTest(t, 2, func(i int, c *Conn) {
+		threePass := i == 1
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "three-pass", threePass)
+		p, err := c.Params()
+		if err != nil {
+			t.Fatal("params failed:", err)
+		}
+		n := p.Frames()
+		if (threePass && n != 3) || (!threePass && n != 1) {
+			t.Fatalf("bad frame count: %d", n)
+		}
+		for j := 0; j < n; j++ {
+			f, err := c.ReadFrame()
+			if err != nil {
+				t.Fatal("read frame failed:", err)
+			}
+			// A buffer of the expected size is filled, not outgrown.
+			if size := p.Lines * p.BytesPerLine; cap(f.data) != size {
+				t.Fatalf("frame buffer holds %d bytes, should hold %d",
+					cap(f.data), size)
+			}
+		}
+		if _, err := c.ReadFrame(); err != ErrLastFrame {
+			t.Fatalf("read frame returned wrong error: %v should be %v",
+				err, ErrLastFrame)
+		}
+		c.Cancel()
+		if _, err := c.ReadFrame(); err != nil {
+			t.Fatal("read frame after cancel failed:", err)
+		}
+		c.Cancel()
+	})
+}
+
+func TestBytesPerSample(t *testing.T) {
+	for _, d := range []int{1, 8, 16} {
+		f := makeFrame(FrameRgb, 1, 1, d)
+		if n := f.BytesPerSample(); n != d/8 {
+			t.Errorf("%d-bit frame has %d bytes per sample", d, n)
+		}
+		if f.Channels != 3 {
+			t.Errorf("RGB frame has %d channels", f.Channels)
+		}
+	}
+}
+
+func TestGray(t *testing.T) {
+	runGrayTest(t, 8, 1, nil)
+}
+
+func TestGrayTwice(t *testing.T) {
+	runGrayTest(t, 8, 2, nil)
+}
+
+func TestColor(t *testing.T) {
+	runColorTest(t, 8, 1, nil)
+}
+
+func TestColorTwice(t *testing.T) {
+	runColorTest(t, 8, 2, nil)
+}
+
+func TestThreePass(t *testing.T) {
+	runColorTest(t, 8, len(threePassOrder), func(i int, c *Conn) {
+		setOption(t, c, "three-pass", true)
+		setOption(t, c, "three-pass-order", threePassOrder[i])
+	})
+}
+
+func TestThreePassBlueFirst(t *testing.T) {
+	runColorTest(t, 8, 1, func(i int, c *Conn) {
+		setOption(t, c, "three-pass", true)
+		setOption(t, c, "three-pass-order", "BGR")
+		f, err := c.ReadFrame()
+		if err != nil {
+			t.Fatal("read frame failed:", err)
+		}
+		c.Cancel()
+		if f.Format != FrameBlue {
+			t.Fatalf("first frame has format %v, should be blue", f.Format)
+		}
+	})
+}
+
+func TestRawFrames(t *testing.T) {
+	for _, threePass := range []bool{false, true} {
+		runTest(t, 1, func(i int, c *Conn) {
+			setOption(t, c, "mode", "Color")
+			setOption(t, c, "depth", 8)
+			setOption(t, c, "test-picture", "Color pattern")
+			setOption(t, c, "three-pass", threePass)
+			setResAndSize(t, c, 8)
+			pool := &countingPool{}
+			c.SetBufferPool(pool)
+			defer c.SetBufferPool(nil)
+			var buf bytes.Buffer
+			if err := c.DumpRawFrames(&buf); err != nil {
+				t.Fatal("dump failed:", err)
+			}
+			if pool.out != 0 {
+				t.Errorf("%d buffers not returned to the pool", pool.out)
+			}
+			m, err := LoadRawFrames(&buf)
+			if err != nil {
+				t.Fatal("load failed:", err)
+			}
+			checkColor(t, m, 8)
+		})
+	}
+	if _, err := LoadRawFrames(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Fatal("load of garbage should fail")
+	}
+	for _, h := range []rawHeader{
+		{Format: int32(FrameGray), Width: -1, Height: 1, Depth: 8, BytesPerLine: 1},
+		{Format: int32(FrameGray), Width: 1, Height: 1 << 30, Depth: 8, BytesPerLine: 1 << 30},
+		{Format: int32(FrameGray), Width: 1, Height: 1, Depth: 4, BytesPerLine: 1},
+		{Format: 9, Width: 1, Height: 1, Depth: 8, BytesPerLine: 1},
+		{Format: int32(FrameRgb), Width: 2, Height: 1, Depth: 8, BytesPerLine: 3},
+	} {
+		var buf bytes.Buffer
+		z := zlib.NewWriter(&buf)
+		io.WriteString(z, rawMagic)
+		binary.Write(z, binary.BigEndian, &h)
+		z.Write([]byte{0, 0, 0})
+		z.Close()
+		if _, err := LoadRawFrames(&buf); err != ErrBadDump {
+			t.Fatalf("load of %+v returned wrong error: %v should be %v", h, err, ErrBadDump)
+		}
+	}
+	// A three-pass dump missing its green frame.
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	io.WriteString(z, rawMagic)
+	for _, h := range []rawHeader{
+		{Format: int32(FrameRed), Width: 1, Height: 1, Depth: 8, BytesPerLine: 1},
+		{Format: int32(FrameBlue), Width: 1, Height: 1, Depth: 8, BytesPerLine: 1, IsLast: true},
+	} {
+		binary.Write(z, binary.BigEndian, &h)
+		z.Write([]byte{0})
+	}
+	z.Close()
+	if _, err := LoadRawFrames(&buf); err != ErrBadDump {
+		t.Fatalf("load without green frame returned wrong error: %v should be %v",
+			err, ErrBadDump)
+	}
+}
+
+func TestCheckFrames(t *testing.T) {
+	red, blue := makeFrame(FrameRed, 2, 2, 8), makeFrame(FrameBlue, 2, 2, 8)
+	m := Image{fs: [3]*Frame{red, nil, blue}}
+	if err := m.checkFrames(); err == nil {
+		t.Fatal("red and blue frames without green should fail")
+	}
+	m.fs[1] = makeFrame(FrameGreen, 2, 3, 8)
+	if err := m.checkFrames(); err == nil {
+		t.Fatal("frames of different sizes should fail")
+	}
+	m.fs[1] = makeFrame(FrameGreen, 2, 2, 8)
+	if err := m.checkFrames(); err != nil {
+		t.Fatal("check frames failed:", err)
+	}
+}
+
+func TestHandScanner(t *testing.T) {
+	runColorTest(t, 8, 1, func(i int, c *Conn) {
+		setOption(t, c, "hand-scanner", true)
+	})
+}
+
+func TestHandScannerBounds(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Gray")
+		setOption(t, c, "hand-scanner", true)
+		p, err := c.Params()
+		if err != nil {
+			t.Fatal("params failed:", err)
+		}
+		if p.Lines != -1 {
+			t.Fatalf("hand scanner reports %d lines, should be -1", p.Lines)
+		}
+		f, err := c.ReadFrame()
+		if err != nil {
+			t.Fatal("read frame failed:", err)
+		}
+		c.Cancel()
+		if f.Height <= 0 || f.Height*f.BytesPerLine != len(f.Data()) {
+			t.Fatalf("bad height %d for %d bytes of %d-byte lines",
+				f.Height, len(f.Data()), f.BytesPerLine)
+		}
+		m := Image{fs: [3]*Frame{f}}
+		if b := m.Bounds(); b.Dy() != f.Height || b.Dx() != p.PixelsPerLine {
+			t.Fatalf("bad bounds %v", b)
+		}
+	})
+}
+
+func TestReadImageUnknownHeight(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Gray")
+		setOption(t, c, "hand-scanner", true)
+		p, err := c.Params()
+		if err != nil {
+			t.Fatal("params failed:", err)
+		}
+		if p.Lines != -1 {
+			t.Fatalf("hand scanner reports %d lines, should be -1", p.Lines)
+		}
+		m := readImage(t, c)
+		// Read one line at a time to grow the buffer many times.
+		c.SetReadBufferSize(p.BytesPerLine)
+		defer c.SetReadBufferSize(0)
+		n := readImage(t, c)
+		b := m.Bounds()
+		if b.Dx() != p.PixelsPerLine || b.Dy() == 0 || n.Bounds() != b {
+			t.Fatalf("bad bounds %v and %v, should be %d pixels wide",
+				b, n.Bounds(), p.PixelsPerLine)
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if m.At(x, y) != n.At(x, y) {
+					t.Fatalf("images differ at (%d,%d)", x, y)
+				}
+			}
+		}
+	})
+}
+
+func TestTinyReads(t *testing.T) {
+	// A 7-byte buffer splits samples and pixels across reads.
+	for _, d := range []int{8, 16} {
+		runColorTest(t, d, 1, func(i int, c *Conn) {
+			setOption(t, c, "three-pass", true)
+			c.SetReadBufferSize(7)
+		})
+	}
+}
+
+func TestPadding(t *testing.T) {
+	runColorTest(t, 8, 1, func(i int, c *Conn) {
+		setOption(t, c, "ppl-loss", 7)
+	})
+}
+
+func TestFramePadding(t *testing.T) {
+	runColorTest(t, 8, 1, func(i int, c *Conn) {
+		setOption(t, c, "ppl-loss", 7)
+		f, err := c.ReadFrame()
+		if err != nil {
+			t.Fatal("read frame failed:", err)
+		}
+		c.Cancel()
+		if f.Pad != 3*7 {
+			t.Fatalf("bad frame padding: %d bytes should be %d", f.Pad, 3*7)
+		}
+		if f.BytesPerLine != 3*f.Width+f.Pad {
+			t.Fatalf("bad frame stride: %d bytes per line should be %d+%d",
+				f.BytesPerLine, 3*f.Width, f.Pad)
+		}
+		if len(f.Data()) != f.BytesPerLine*f.Height {
+			t.Fatalf("bad frame data length: %d should be %d",
+				len(f.Data()), f.BytesPerLine*f.Height)
+		}
+		last := make([]uint16, 3*f.Height)
+		for y := 0; y < f.Height; y++ {
+			for ch := 0; ch < 3; ch++ {
+				last[3*y+ch] = f.At(f.Width-1, y, ch)
+			}
+			for k := 1; k <= f.Pad; k++ {
+				f.data[f.BytesPerLine*(y+1)-k] = 0xab
+			}
+		}
+		for y := 0; y < f.Height; y++ {
+			for ch := 0; ch < 3; ch++ {
+				if v := f.At(f.Width-1, y, ch); v != last[3*y+ch] {
+					t.Fatalf("sample at (%d,%d) changed with the padding", f.Width-1, y)
+				}
+			}
+			if v := f.At(f.Width, y, 0); v != 0 {
+				t.Fatalf("sample past the end of line %d is %d, should be 0", y, v)
+			}
+		}
+	})
+}
+
+func TestFuzzyParams(t *testing.T) {
+	runColorTest(t, 8, 1, func(i int, c *Conn) {
+		setOption(t, c, "fuzzy-parameters", true)
+	})
+}
+
+func TestReadError(t *testing.T) {
+	errList := []struct {
+		s string
+		e Error
+	}{
+		{"SANE_STATUS_UNSUPPORTED", ErrUnsupported},
+		{"SANE_STATUS_CANCELLED", ErrCancelled},
+		{"SANE_STATUS_DEVICE_BUSY", ErrBusy},
+		{"SANE_STATUS_INVAL", ErrInvalid},
+		{"SANE_STATUS_JAMMED", ErrJammed},
+		{"SANE_STATUS_NO_DOCS", ErrEmpty},
+		{"SANE_STATUS_COVER_OPEN", ErrCoverOpen},
+		{"SANE_STATUS_IO_ERROR", ErrIo},
+		{"SANE_STATUS_NO_MEM", ErrNoMem},
+		{"SANE_STATUS_ACCESS_DENIED", ErrDenied},
+	}
+	runTest(t, len(errList), func(i int, c *Conn) {
+		setOption(t, c, "read-return-value", errList[i].s)
+		_, err := c.ReadImage()
+		if err != errList[i].e {
+			t.Fatalf("ReadImage returned wrong error: %v should be %v",
+				err, errList[i].e)
+		}
+	})
+}
+
+func TestStatusError(t *testing.T) {
+	var err Error = StatusError(42)
+	if s := err.Error(); s != "sane: unknown status code 42" {
+		t.Fatalf("bad message for unknown status: %q", s)
+	}
+	// A status returned by a failed call maps to its sentinel error.
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Gray") // three-pass is inactive
+		_, err := c.GetOption("three-pass")
+		if _, ok := err.(StatusError); ok || err != ErrInvalid {
+			t.Fatalf("get inactive option returned wrong error: %v should be %v",
+				err, ErrInvalid)
+		}
+	})
+}
+
+func TestNonBlocking(t *testing.T) {
+	runTest(t, 2, func(i int, c *Conn) {
+		setOption(t, c, "non-blocking", i == 1)
+		setOption(t, c, "select-fd", i == 1)
+		if err := c.Start(); err != nil {
+			t.Fatal("start failed:", err)
+		}
+		defer c.Cancel()
+		err := c.SetNonBlocking(true)
+		_, fdErr := c.SelectFD()
+		if i == 0 && (err != ErrUnsupported || fdErr != ErrUnsupported) {
+			t.Fatalf("non-blocking mode should be unsupported: %v, %v", err, fdErr)
+		}
+		if i == 1 && (err != nil || fdErr != nil) {
+			t.Fatalf("non-blocking mode failed: %v, %v", err, fdErr)
+		}
+	})
+}
+
+func TestFeeder(t *testing.T) {
+	// Feeder has 10 pages
+	runTest(t, 11, func(i int, c *Conn) {
+		if i == 0 {
+			setOption(t, c, "source", "Automatic Document Feeder")
+			setOption(t, c, "mode", "Color")
+			setOption(t, c, "test-picture", "Color pattern")
+		}
+		if i < 10 {
+			checkColor(t, readImage(t, c), 8)
+		} else if _, err := c.ReadImage(); err != ErrEmpty {
+			t.Fatalf("feeder not empty after 10 pages")
+		}
+	})
+}
+
+func TestFeederBoundary(t *testing.T) {
+	// Feeder has 10 pages
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "three-pass", true)
+		defer c.Cancel()
+		for page := 0; page < 10; page++ {
+			for n := 0; ; n++ {
+				f, err := c.readFrame()
+				if err != nil {
+					t.Fatalf("read of frame %d of page %d failed: %v", n, page, err)
+				}
+				if f.Height == 0 {
+					t.Fatalf("frame %d of page %d is empty", n, page)
+				}
+				if f.IsLast {
+					if n != 2 {
+						t.Fatalf("page %d ended after %d frames", page, n+1)
+					}
+					break
+				}
+			}
+		}
+		if _, err := c.readFrame(); err != ErrEmpty {
+			t.Fatalf("read after last page returned wrong error: %v should be %v",
+				err, ErrEmpty)
+		}
+	})
+}
+
+func TestConcurrentDevices(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal("init failed:", err)
+	}
+	defer Exit()
+	var conns [2]*Conn
+	for i := range conns {
+		c, err := Open(fmt.Sprintf("%s:%d", TestDevice, i))
+		if err != nil {
+			t.Fatal("open failed:", err)
+		}
+		defer c.Close()
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "test-picture", "Color pattern")
+		setResAndSize(t, c, 8)
+		conns[i] = c
+	}
+	var images [2][]*Image
+	errs := make(chan error, len(conns))
+	for i, c := range conns {
+		go func(i int, c *Conn) {
+			for j := 0; j < 3; j++ {
+				m, err := c.ReadImage()
+				if err != nil {
+					errs <- err
+					return
+				}
+				images[i] = append(images[i], m)
+			}
+			errs <- nil
+		}(i, c)
+	}
+	for range conns {
+		if err := <-errs; err != nil {
+			t.Fatal("read image failed:", err)
+		}
+	}
+	for _, imgs := range images {
+		for _, m := range imgs {
+			checkColor(t, m, 8)
+		}
+	}
+}
+
+func TestProbeDevice(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal("init failed:", err)
+	}
+	defer Exit()
+	if err := Probe(TestDevice); err != nil {
+		t.Fatal("probe failed:", err)
+	}
+	if err := Probe("no-such-device"); err == nil {
+		t.Fatal("probe of nonexistent device succeeded")
+	}
+}
+
+func TestOpenContext(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal("init failed:", err)
+	}
+	defer Exit()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := OpenContext(ctx, TestDevice)
+	if err != nil {
+		t.Fatal("open failed:", err)
+	}
+	c.Close()
+}
+
+func TestAuthCallback(t *testing.T) {
+	SetAuthCallback(func(resource string) (string, string) {
+		return "user", "secret:" + resource
+	})
+	defer SetAuthCallback(nil)
+	if u, p := credentials("net:host"); u != "user" || p != "secret:net:host" {
+		t.Errorf("wrong credentials %q, %q", u, p)
+	}
+}
+
+func TestDocumentsRemaining(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		// The test device does not report a page count.
+		if n, ok := c.DocumentsRemaining(); ok || n != 0 {
+			t.Errorf("documents remaining returned %d, %v", n, ok)
+		}
+	})
+}
+
+func TestReorderDuplex(t *testing.T) {
+	imgs := make([]*Image, 5)
+	for i := range imgs {
+		imgs[i] = &Image{}
+	}
+	cases := []struct {
+		mode  DuplexMode
+		order []int
+	}{
+		{DuplexInterleaved, []int{0, 1, 2, 3, 4}},
+		{DuplexFrontsFirst, []int{0, 3, 1, 4, 2}},
+		{DuplexBacksReversed, []int{0, 4, 1, 3, 2}},
+	}
+	for _, tc := range cases {
+		out := ReorderDuplex(imgs, tc.mode)
+		for i, j := range tc.order {
+			if out[i] != imgs[j] {
+				t.Errorf("mode %d: image %d should be input %d", tc.mode, i, j)
+			}
+			if side := SideFront + Side(i%2); out[i].Side != side {
+				t.Errorf("mode %d: image %d has side %d, should be %d",
+					tc.mode, i, out[i].Side, side)
+			}
+		}
+	}
+}
+
+func TestReadAvailableImages(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "test-picture", "Color pattern")
+		images, err := c.ReadAvailableImages()
+		if err != nil {
+			t.Error("Read available images failed")
+		}
+		// Feeder has 10 pages
+		if len(images) != 10 {
+			t.Errorf("Wrong length of images array: %d", len(images))
+		}
+		for _, im := range images {
+			checkColor(t, im, 8)
+		}
+	})
+}
+
+func TestReadAvailableImagesEmpty(t *testing.T) {
+	runTest(t, 2, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		// The first call empties the feeder.
+		images, err := c.ReadAvailableImages()
+		if i == 1 && (err != nil || len(images) != 0) {
+			t.Fatalf("empty feeder returned %d images and error %v",
+				len(images), err)
+		}
+	})
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		setOption(t, c, "read-return-value", "SANE_STATUS_JAMMED")
+		if _, err := c.ReadAvailableImages(); err != ErrJammed {
+			t.Fatalf("jammed feeder returned wrong error: %v should be %v",
+				err, ErrJammed)
+		}
+	})
+}
+
+func TestAutoCancel(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		c.SetAutoCancel(false)
+		defer c.SetAutoCancel(true)
+		for j := 0; j < 3; j++ {
+			readImage(t, c)
+		}
+		if c.MoreFrames() {
+			t.Error("scan was cancelled")
+		}
+		c.Cancel()
+	})
+}
+
+func TestReadAvailableImagesFunc(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		seen := 0
+		images, err := c.ReadAvailableImagesFunc(func(i int, m *Image) (bool, error) {
+			if i != seen {
+				t.Errorf("wrong index %d, expected %d", i, seen)
+			}
+			seen++
+			return i == 2, nil
+		})
+		if err != nil {
+			t.Fatal("read available images failed:", err)
+		}
+		if len(images) != 3 {
+			t.Errorf("stopped batch returned %d images, expected 3", len(images))
+		}
+	})
+}
+
+func TestContinuousRead(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "test-picture", "Color pattern")
+
+		var cnt = 0
+		err := c.ContinuousRead(func(m *Image) error {
+			checkColor(t, m, 8)
+			cnt++
+			return nil
+		})
+		if err != nil {
+			t.Error("Continuous failed")
+		}
+		// Feeder has 10 pages
+		if cnt != 10 {
+			t.Errorf("Wrong count of processed images: %d", cnt)
+		}
+	})
+}
+
+func TestFeederThreePass(t *testing.T) {
+	// Feeder has 10 pages
+	runTest(t, 11, func(i int, c *Conn) {
+		if i == 0 {
+			setOption(t, c, "source", "Automatic Document Feeder")
+			setOption(t, c, "mode", "Color")
+			setOption(t, c, "test-picture", "Color pattern")
+			setOption(t, c, "three-pass", true)
+		}
+		if i < 10 {
+			checkColor(t, readImage(t, c), 8)
+		} else if _, err := c.ReadImage(); err != ErrEmpty {
+			t.Fatalf("feeder not empty after 10 pages")
+		}
+	})
+}
+
+func TestInjectReadError(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		if err := c.InjectReadError("SANE_STATUS_JAMMED"); err != nil {
+			t.Fatal("inject read error failed:", err)
+		}
+		if _, err := c.ReadImage(); err != ErrJammed {
+			t.Fatalf("ReadImage returned wrong error: %v should be %v",
+				err, ErrJammed)
+		}
+		if err := c.InjectReadError("Default"); err != nil {
+			t.Fatal("inject read error failed:", err)
+		}
+		readImage(t, c)
+	})
+}
+
+func TestReadImageWithMeta(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "resolution", 75.0)
+		_, meta, err := c.ReadImageWithMeta()
+		if err != nil {
+			t.Fatal("read failed:", err)
+		}
+		if meta.Mode != "Color" || meta.Resolution != 75 {
+			t.Errorf("bad metadata: %+v", meta)
+		}
+		if meta.Device.Name != c.Device || meta.Time.IsZero() {
+			t.Errorf("bad metadata: %+v", meta)
+		}
+	})
+	// A device opened without listing devices first is looked up.
+	if err := Init(); err != nil {
+		t.Fatal("init failed:", err)
+	}
+	defer Exit()
+	knownMu.Lock()
+	known = nil
+	knownMu.Unlock()
+	c, err := Open("test:0")
+	if err != nil {
+		t.Fatal("open failed:", err)
+	}
+	defer c.Close()
+	if _, meta, err := c.ReadImageWithMeta(); err != nil {
+		t.Fatal("read failed:", err)
+	} else if meta.Device.Vendor == "" || meta.Device.Model == "" {
+		t.Errorf("device not looked up: %+v", meta.Device)
+	}
+}
+
+func TestReadImageWithPolicy(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "read-return-value", "SANE_STATUS_IO_ERROR")
+		n := 0
+		p := RetryPolicy{
+			Attempts: 2,
+			RetryOn:  []error{ErrIo},
+			OnRetry: func(err error) {
+				n++
+				setOption(t, c, "read-return-value", "Default")
+			},
+		}
+		if _, err := c.ReadImageWithPolicy(p); err != nil {
+			t.Fatal("read image with policy failed:", err)
+		}
+		if n != 1 {
+			t.Fatalf("policy retried %d times, should retry once", n)
+		}
+	})
+}
+
+func TestProbe(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		p, err := c.Probe()
+		if err != nil {
+			t.Fatal("probe failed:", err)
+		}
+		if p.PixelsPerLine <= 0 || p.BytesPerLine <= 0 {
+			t.Fatalf("probe returned bad params: %+v", p)
+		}
+		readImage(t, c) // connection remains usable
+	})
+}
+
+func TestStats(t *testing.T) {
+	runTest(t, 2, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		imgs, err := c.ReadImages(2)
+		if err != nil {
+			t.Fatal("read images failed:", err)
+		}
+		st := c.Stats()
+		var n int64
+		for _, m := range imgs {
+			n += int64(len(m.fs[0].Data()))
+		}
+		if st.Pages != 2 || st.BytesRead != n || st.Reads == 0 {
+			t.Fatalf("bad stats for %d bytes in 2 pages: %+v", n, st)
+		}
+	})
+}
+
+func TestEncodePNGWithDPI(t *testing.T) {
+	runGrayTest(t, 8, 1, func(i int, c *Conn) {
+		m, err := c.ReadImage()
+		if err != nil {
+			t.Fatal("read image failed:", err)
+		}
+		var buf bytes.Buffer
+		if err := EncodePNGWithDPI(300)(&buf, m); err != nil {
+			t.Fatal("encode failed:", err)
+		}
+		if _, err := png.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal("decode PNG failed:", err)
+		}
+		k := bytes.Index(buf.Bytes(), []byte("pHYs"))
+		if k < 0 {
+			t.Fatal("no pHYs chunk")
+		}
+		b := buf.Bytes()[k+4:]
+		x, y := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+		if x != 11811 || y != 11811 || b[8] != 1 {
+			t.Errorf("wrong resolution %d x %d, unit %d", x, y, b[8])
+		}
+	})
+}
+
+// tiffPages returns the values of the given tags for each page of a
+// little-endian TIFF file.
+func tiffPages(t *testing.T, b []byte, tags ...uint16) [][]uint32 {
+	le := binary.LittleEndian
+	if string(b[:4]) != "II*\x00" {
+		t.Fatalf("bad TIFF header %q", b[:4])
+	}
+	var pages [][]uint32
+	for off := le.Uint32(b[4:]); off != 0; {
+		if off%2 != 0 || int(off) >= len(b) {
+			t.Fatalf("bad directory offset %d", off)
+		}
+		n := int(le.Uint16(b[off:]))
+		vals := make([]uint32, len(tags))
+		for i := 0; i < n; i++ {
+			e := b[int(off)+2+12*i:]
+			for j, tag := range tags {
+				if le.Uint16(e) != tag {
+					continue
+				}
+				if le.Uint16(e[2:]) == 3 {
+					vals[j] = uint32(le.Uint16(e[8:]))
+				} else {
+					vals[j] = le.Uint32(e[8:])
+				}
+			}
+		}
+		pages = append(pages, vals)
+		off = le.Uint32(b[int(off)+2+12*n:])
+	}
+	return pages
+}
+
+func TestTIFFWriter(t *testing.T) {
+	for _, d := range []int{1, 8, 16} {
+		runTest(t, 2, func(i int, c *Conn) {
+			mode, spp := "Gray", 1
+			if i == 1 {
+				mode, spp = "Color", 3
+			}
+			setOption(t, c, "mode", mode)
+			setOption(t, c, "depth", d)
+			m := readImage(t, c)
+			var buf bytes.Buffer
+			w := NewTIFFWriter(&buf, &TIFFOptions{DPI: 300})
+			for j := 0; j < 3; j++ {
+				if err := w.AddPage(m); err != nil {
+					t.Fatal("add page failed:", err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal("close failed:", err)
+			}
+			if err := w.AddPage(m); err != ErrTIFFClosed {
+				t.Fatalf("add page after close returned wrong error: %v should be %v",
+					err, ErrTIFFClosed)
+			}
+			if err := w.Close(); err != ErrTIFFClosed {
+				t.Fatalf("second close returned wrong error: %v should be %v",
+					err, ErrTIFFClosed)
+			}
+			b := m.Bounds()
+			bits := d
+			if spp == 3 && d == 1 {
+				bits = 8
+			}
+			size := uint32(b.Dy() * b.Dx() * spp * bits / 8)
+			if bits == 1 {
+				size = uint32(b.Dy() * ((b.Dx() + 7) / 8))
+			}
+			pages := tiffPages(t, buf.Bytes(), 256, 257, 277, 273, 279)
+			if len(pages) != 3 {
+				t.Fatalf("TIFF has %d pages, should have 3", len(pages))
+			}
+			for _, p := range pages {
+				exp := []uint32{uint32(b.Dx()), uint32(b.Dy()), uint32(spp)}
+				if !reflect.DeepEqual(p[:3], exp) || p[4] != size {
+					t.Errorf("bad page tags %v, should start with %v and size %d",
+						p, exp, size)
+				}
+				if int(p[3]+p[4]) > buf.Len() {
+					t.Errorf("page data at %d+%d is past the end", p[3], p[4])
+				}
+			}
+		})
+	}
+	if err := NewTIFFWriter(ioutil.Discard, nil).Close(); err != ErrNoPages {
+		t.Fatalf("empty TIFF returned wrong error: %v should be %v", err, ErrNoPages)
+	}
+	runTest(t, 1, func(i int, c *Conn) {
+		m := readImage(t, c)
+		w := NewTIFFWriter(ioutil.Discard, nil)
+		if err := w.AddPage(m); err != nil {
+			t.Fatal("add page failed:", err)
+		}
+		w.off = math.MaxUint32 - 100 // as if 4 GiB had been written
+		if err := w.AddPage(m); err != ErrTIFFTooLarge {
+			t.Fatalf("add page past 4 GiB returned wrong error: %v should be %v",
+				err, ErrTIFFTooLarge)
+		}
+	})
+}
+
+func TestWriteZIP(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		imgs, err := c.ReadImages(3)
+		if err != nil {
+			t.Fatal("read images failed:", err)
+		}
+		var buf bytes.Buffer
+		name := func(i int) string { return fmt.Sprintf("%d.png", i) }
+		if err := WriteZIP(&buf, imgs, EncodePNG, name); err != nil {
+			t.Fatal("write ZIP failed:", err)
+		}
+		r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal("read ZIP failed:", err)
+		}
+		if len(r.File) != len(imgs) {
+			t.Fatalf("ZIP has %d files, should have %d", len(r.File), len(imgs))
+		}
+		for i, f := range r.File {
+			if f.Name != name(i) {
+				t.Errorf("file %d is named %s, should be %s", i, f.Name, name(i))
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal("open file failed:", err)
+			}
+			m, err := png.Decode(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal("decode PNG failed:", err)
+			}
+			if m.Bounds() != imgs[i].Bounds() {
+				t.Errorf("file %d has bounds %v, should be %v",
+					i, m.Bounds(), imgs[i].Bounds())
+			}
+		}
+	})
+}
+
+func TestReadDeadline(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		c.SetReadDeadline(time.Now().Add(-time.Second))
+		if _, err := c.ReadImage(); err != ErrTimeout {
+			t.Fatalf("ReadImage returned wrong error: %v should be %v",
+				err, ErrTimeout)
+		}
+		c.SetReadDeadline(time.Time{})
+		readImage(t, c)
+	})
+}
+
+func TestRestoreDefaults(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		mode := getOption(t, c, "mode")
+		depth := getOption(t, c, "depth")
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "mode", "Gray")
+		setOption(t, c, "depth", 16)
+		if err := c.RestoreDefaults(); err != nil {
+			t.Fatal("restore defaults failed:", err)
+		}
+		if v := getOption(t, c, "mode"); v != mode {
+			t.Errorf("mode is %v, should be %v", v, mode)
+		}
+		if v := getOption(t, c, "depth"); v != depth {
+			t.Errorf("depth is %v, should be %v", v, depth)
+		}
+	})
+}
+
+func TestConnPool(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal("init failed:", err)
+	}
+	defer Exit()
+	p, err := NewConnPool(TestDevice, 1)
+	if err != nil {
+		t.Fatal("new pool failed:", err)
+	}
+	defer p.Close()
+	c1, err := p.Get()
+	if err != nil {
+		t.Fatal("get failed:", err)
+	}
+	mode := getOption(t, c1, "mode")
+	setOption(t, c1, "mode", "Color")
+	readImage(t, c1)
+	p.Put(c1)
+	c2, err := p.Get()
+	if err != nil {
+		t.Fatal("get failed:", err)
+	}
+	defer p.Put(c2)
+	if c2 != c1 || c2.handle != c1.handle {
+		t.Fatal("pool did not reuse connection")
+	}
+	if m := getOption(t, c2, "mode"); m != mode {
+		t.Fatalf("pool did not reset options: mode %v should be %v", m, mode)
+	}
+	readImage(t, c2)
+	p.Close()
+	if _, err := p.Get(); err != ErrClosed {
+		t.Fatalf("get after close returned wrong error: %v should be %v", err, ErrClosed)
+	}
+}
+
+func TestWaitForDocuments(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Flatbed")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := c.WaitForDocuments(ctx); err != nil {
+			t.Fatal("wait failed:", err)
+		}
+	})
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		if _, err := c.ReadAvailableImages(); err != nil {
+			t.Fatal("read available images failed:", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := c.WaitForDocuments(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("wait on empty feeder returned wrong error: %v should be %v",
+				err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestReadImages(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		for _, n := range []int{2, 1} {
+			ms, err := c.ReadImages(n)
+			if err != nil {
+				t.Fatal("read images failed:", err)
+			}
+			if len(ms) != n {
+				t.Fatalf("read %d images, should be %d", len(ms), n)
+			}
+		}
+	})
+}
+
+func TestContinuousReadContext(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		n := 0
+		err := c.ContinuousReadContext(ctx, func(m *Image) error {
+			n++
+			cancel()
+			return nil
+		})
+		if err != context.Canceled {
+			t.Fatalf("continuous read returned wrong error: %v should be %v",
+				err, context.Canceled)
+		}
+		if n != 1 {
+			t.Fatalf("processed %d images after cancel, should be 1", n)
+		}
+	})
+}
+
+func TestWarmUp(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := c.WarmUp(ctx); err != nil {
+			t.Fatal("warm up failed:", err)
+		}
+		// The test device has no lamp settings.
+		if err := c.SetLamp(false); err != ErrUnsupported {
+			t.Fatalf("set lamp returned wrong error: %v should be %v",
+				err, ErrUnsupported)
+		}
+		if _, err := c.LampOffTime(); err != ErrUnsupported {
+			t.Fatalf("lamp off time returned wrong error: %v should be %v",
+				err, ErrUnsupported)
+		}
+	})
+}
+
+func TestCalibrate(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		// The test device has no calibration button.
+		if err := c.Calibrate(context.Background()); err != ErrUnsupported {
+			t.Fatalf("calibrate returned wrong error: %v should be %v",
+				err, ErrUnsupported)
+		}
+	})
+}
+
+func TestStreamPages(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "three-pass", true)
+		n := 0
+		err := c.StreamPages(context.Background(), func(i int, r io.Reader, p *Params) error {
+			if i != n {
+				t.Fatalf("got page %d, should be %d", i, n)
+			}
+			n++
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if want := 3 * p.Lines * p.BytesPerLine; len(b) != want {
+				t.Fatalf("page %d has %d bytes, should be %d", i, len(b), want)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal("stream pages failed:", err)
+		}
+		if n == 0 {
+			t.Fatal("no pages streamed")
+		}
+	})
+}
+
+func TestSides(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		imgs, err := c.ReadAvailableImages()
+		if err != nil {
+			t.Fatal("read available images failed:", err)
+		}
+		for i, m := range imgs {
+			if m.Side != SideFront {
+				t.Fatalf("image %d has side %d, should be front", i, m.Side)
+			}
+		}
+	})
+}
+
+func TestDetectDoubleFeed(t *testing.T) {
+	var imgs []*Image
+	runTest(t, 3, func(i int, c *Conn) {
+		if i < 2 {
+			setOption(t, c, "test-picture", "Color pattern")
+		} else {
+			setOption(t, c, "test-picture", "Grid")
+		}
+		imgs = append(imgs, readImage(t, c))
+	})
+	if !DetectDoubleFeed(imgs[0], imgs[1]) {
+		t.Error("identical pages should be flagged as a double feed")
+	}
+	if DetectDoubleFeed(imgs[1], imgs[2]) {
+		t.Error("distinct pages should not be flagged as a double feed")
+	}
+	empty := &Image{fs: [3]*Frame{makeFrame(FrameGray, imgs[0].Bounds().Dx(), 0, 8)}}
+	if DetectDoubleFeed(empty, imgs[0]) {
+		t.Error("page after an empty page should not be flagged as a double feed")
+	}
+	var blank [2]*Image
+	for i := range blank {
+		f := makeFrame(FrameGray, 64, 64, 8)
+		for j := range f.data {
+			f.data[j] = 0xff
+		}
+		blank[i] = &Image{fs: [3]*Frame{f}}
+	}
+	if DetectDoubleFeed(blank[0], blank[1]) {
+		t.Error("blank pages should not be flagged as a double feed")
+	}
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "source", "Automatic Document Feeder")
+		setOption(t, c, "test-picture", "Color pattern")
+		c.SetDoubleFeedDetection(true)
+		ms, err := c.ReadAvailableImages()
+		if err != ErrDoubleFeed || len(ms) != 1 {
+			t.Fatalf("read available images returned %d images and %v, should be 1 and %v",
+				len(ms), err, ErrDoubleFeed)
+		}
+	})
+}
+
+func TestCancel(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		b := make([]byte, 10)
+		if err := c.Start(); err != nil {
+			t.Fatalf("start failed: %v", err)
+		}
+		c.Cancel()
+		_, err := c.Read(b)
+		if err != ErrCancelled {
+			t.Fatalf("read returned wrong error: %v should be %v",
+				err, ErrCancelled)
+		}
+	})
+}
+
+func TestCancelConcurrent(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "read-limit", true)
+		setOption(t, c, "read-limit-size", 1)
+		setOption(t, c, "read-delay", true) // each byte takes a millisecond
+		time.AfterFunc(50*time.Millisecond, c.Cancel)
+		if _, err := c.ReadFrame(); err != ErrCancelled {
+			t.Fatalf("read frame returned wrong error: %v should be %v",
+				err, ErrCancelled)
+		}
+		c.Cancel()
+	})
+}
+
+func TestCancelTwice(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		c.Cancel() // never started
+		if err := c.Start(); err != nil {
+			t.Fatalf("start failed: %v", err)
+		}
+		c.Cancel()
+		c.Cancel()
+		c.Close()
+		c.Cancel() // after close
+		c.Close()
+	})
+}
+
 func TestGrayBitmap(t *testing.T) {
 	runGrayTest(t, 1, 1, nil)
 }
@@ -820,3 +3061,273 @@ func TestThreePass16(t *testing.T) {
 func TestGray16(t *testing.T) {
 	runGrayTest(t, 16, 1, nil)
 }
+
+func TestButtonScans(t *testing.T) {
+	const button = "bool-soft-select-soft-detect"
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "enable-test-options", true)
+		setOption(t, c, button, false)
+		// The button is pressed and released from the polling goroutine,
+		// since the connection must not be used concurrently: each poll
+		// flips it, and it is left released after two presses.
+		presses := 0
+		c.pollHook = func(pressed bool) {
+			if !pressed && presses == 2 {
+				return
+			}
+			if !pressed {
+				presses++
+			}
+			if _, err := c.SetOption(button, !pressed); err != nil {
+				t.Error("set option failed:", err)
+			}
+		}
+		defer func() { c.pollHook = nil }()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cfg := ScanConfig{
+			Options:      map[string]interface{}{"mode": "Color", "depth": 8},
+			PollInterval: time.Millisecond,
+		}
+		ch, err := c.ButtonScans(ctx, button, cfg)
+		if err != nil {
+			t.Fatal("button scans failed:", err)
+		}
+		for n := 0; n < 2; n++ {
+			r := <-ch
+			if r.Err != nil {
+				t.Fatalf("scan %d failed: %v", n, r.Err)
+			}
+			if r.Image.ColorModel() != color.RGBAModel {
+				t.Fatalf("scan %d has wrong color model", n)
+			}
+		}
+		cancel()
+		for r := range ch {
+			t.Fatalf("unexpected scan after cancel: %v", r)
+		}
+		_, err = c.ButtonScans(context.Background(), "int", cfg)
+		if e, ok := err.(*OptionTypeError); !ok || e.Unwrap() != ErrInvalid {
+			t.Fatalf("button scans on int option returned wrong error: %v", err)
+		}
+	})
+}
+
+func TestScanner(t *testing.T) {
+	s, err := NewScanner(TestDevice)
+	if err != nil {
+		t.Fatal("new scanner failed:", err)
+	}
+	defer s.Close()
+	cfg := Settings{
+		Mode:       "Color",
+		Resolution: 127, // 40x20 mm is exactly 200x100 pixels
+		Area:       &Rect{Left: 0, Top: 0, Right: 40, Bottom: 20},
+	}
+	if err := s.Configure(cfg); err != nil {
+		t.Fatal("configure failed:", err)
+	}
+	m, err := s.Scan()
+	if err != nil {
+		t.Fatal("scan failed:", err)
+	}
+	if b := m.Bounds(); b.Dx() != 200 || b.Dy() != 100 {
+		t.Fatalf("bad bounds: %v should be 200x100", b)
+	}
+	if err := s.Configure(Settings{Mode: "Sepia"}); err == nil {
+		t.Fatal("configure with unsupported mode should fail")
+	}
+	// Closing twice must not release another user's Init.
+	if err := Init(); err != nil {
+		t.Fatal("init failed:", err)
+	}
+	defer Exit()
+	s.Close()
+	s.Close()
+	initMu.Lock()
+	n := initCount
+	initMu.Unlock()
+	if n != 1 {
+		t.Fatalf("init count is %d after closing twice, should be 1", n)
+	}
+}
+
+// countingPool is a BufferPool that counts outstanding buffers.
+type countingPool struct {
+	out int
+}
+
+func (p *countingPool) Get(n int) []byte {
+	p.out++
+	return make([]byte, n)
+}
+
+func (p *countingPool) Put(b []byte) {
+	p.out--
+}
+
+func TestBufferPool(t *testing.T) {
+	runGrayTest(t, 8, 1, func(i int, c *Conn) {
+		pool := &countingPool{}
+		c.SetBufferPool(pool)
+		defer c.SetBufferPool(nil)
+		m := readImage(t, c)
+		if pool.out != 1 {
+			t.Errorf("%d buffers taken from the pool, expected 1", pool.out)
+		}
+		checkGray(t, m, 8)
+		m.Release()
+		if pool.out != 0 {
+			t.Errorf("%d buffers not returned to the pool", pool.out)
+		}
+	})
+}
+
+func TestMoreFrames(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "three-pass", true)
+		n := 0
+		for c.MoreFrames() {
+			if _, err := c.ReadFrame(); err != nil {
+				t.Fatal("read frame failed:", err)
+			}
+			n++
+		}
+		if n != 3 {
+			t.Errorf("read %d frames, expected 3", n)
+		}
+		c.Cancel()
+		if !c.MoreFrames() {
+			t.Error("no more frames expected after Cancel")
+		}
+	})
+}
+
+func TestTypedGetters(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Gray")
+		if v, err := c.GetString("mode"); err != nil || v != "Gray" {
+			t.Errorf("GetString returned %q, %v", v, err)
+		}
+		if v, err := c.GetInt("depth"); err != nil || v != getOption(t, c, "depth") {
+			t.Errorf("GetInt returned %d, %v", v, err)
+		}
+		if v, err := c.GetIntList("depth"); err != nil || len(v) != 1 {
+			t.Errorf("GetIntList returned %v, %v", v, err)
+		}
+		if _, err := c.GetFloat("tl-x"); err != nil {
+			t.Errorf("GetFloat failed: %v", err)
+		}
+		if v, err := c.GetBool("hand-scanner"); err != nil || v {
+			t.Errorf("GetBool returned %v, %v", v, err)
+		}
+		_, err := c.GetInt("mode")
+		if e, ok := err.(*OptionTypeError); !ok || e.Unwrap() != ErrInvalid {
+			t.Errorf("GetInt on string option returned wrong error: %v", err)
+		}
+	})
+}
+
+func TestWiden(t *testing.T) {
+	for _, d := range []int{12, 14} {
+		max := uint16(1)<<uint(d) - 1
+		f := makeFrame(FrameGray, 3, 1, 16)
+		for x, v := range []uint16{0, max / 2, max} {
+			f.set(x, 0, 0, v)
+		}
+		f.Depth = d
+		f.widen()
+		if f.Depth != 16 {
+			t.Fatalf("depth %d widened to %d", d, f.Depth)
+		}
+		if v := f.At(0, 0, 0); v != 0 {
+			t.Errorf("depth %d: black widened to %#x", d, v)
+		}
+		if v := f.At(1, 0, 0); v>>8 != 0x7f {
+			t.Errorf("depth %d: mid gray widened to %#x", d, v)
+		}
+		if v := f.At(2, 0, 0); v != 0xffff {
+			t.Errorf("depth %d: white widened to %#x", d, v)
+		}
+	}
+}
+
+func TestFrameAtUnchecked(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		setOption(t, c, "mode", "Color")
+		setOption(t, c, "test-picture", "Color pattern")
+		f, err := c.ReadFrame()
+		if err != nil {
+			t.Fatal("read frame failed:", err)
+		}
+		c.Cancel()
+		for y := 0; y < f.Height; y += 7 {
+			for x := 0; x < f.Width; x += 7 {
+				for ch := 0; ch < f.Channels; ch++ {
+					if f.At(x, y, ch) != f.AtUnchecked(x, y, ch) {
+						t.Fatalf("samples at (%d,%d,%d) differ", x, y, ch)
+					}
+				}
+			}
+		}
+		for _, p := range [][3]int{{-1, 0, 0}, {f.Width, 0, 0}, {0, f.Height, 0}, {0, 0, f.Channels}} {
+			if v := f.At(p[0], p[1], p[2]); v != 0 {
+				t.Errorf("sample at %v out of range is %d", p, v)
+			}
+		}
+	})
+}
+
+func TestClone(t *testing.T) {
+	runTest(t, 1, func(i int, c *Conn) {
+		o, ok := c.Option("mode")
+		if !ok {
+			t.Fatal("no mode option")
+		}
+		oc := o.Clone()
+		if !reflect.DeepEqual(oc, *o) {
+			t.Fatalf("clone %+v differs from %+v", oc, *o)
+		}
+		oc.ConstrSet[0] = "changed"
+		if o.ConstrSet[0] == "changed" {
+			t.Error("clone shares constraint set with original")
+		}
+		f, err := c.ReadFrame()
+		if err != nil {
+			t.Fatal("read frame failed:", err)
+		}
+		c.Cancel()
+		fc := f.Clone()
+		if !bytes.Equal(fc.Data(), f.Data()) {
+			t.Fatal("cloned frame data differs")
+		}
+		fc.Data()[0]++
+		if fc.Data()[0] == f.Data()[0] {
+			t.Error("cloned frame shares data with original")
+		}
+	})
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	if err := Init(); err != nil {
+		b.Fatal("init failed:", err)
+	}
+	defer Exit()
+	c, err := Open(TestDevice)
+	if err != nil {
+		b.Fatal("open failed:", err)
+	}
+	defer c.Close()
+	for _, n := range []int{0, 1 << 20} {
+		b.Run(fmt.Sprintf("buffer=%d", n), func(b *testing.B) {
+			c.SetReadBufferSize(n)
+			for i := 0; i < b.N; i++ {
+				if _, err := c.ReadFrame(); err != nil {
+					b.Fatal("read frame failed:", err)
+				}
+				c.Cancel()
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const defaultPollInterval = 100 * time.Millisecond
+
+// ScanConfig describes how a scanning workflow configures each scan.
+//
+// Options are set in the order in which the device lists them, since
+// backends list options such as the source and mode, which change the
+// constraints of others, before those they affect. Names the device does not
+// list are set last, in sorted order.
+type ScanConfig struct {
+	Options      map[string]interface{} // option values to set before each scan
+	PollInterval time.Duration          // sensor polling interval, 0 for default
+}
+
+// ScanResult is the outcome of a single scan in a scanning workflow.
+type ScanResult struct {
+	Image *Image // scanned image, nil if Err is set
+	Err   error  // scanning error, if any
+}
+
+func (cfg *ScanConfig) apply(c *Conn) error {
+	names := make([]string, 0, len(cfg.Options))
+	for _, o := range c.Options() {
+		if _, ok := cfg.Options[o.Name]; ok {
+			names = append(names, o.Name)
+		}
+	}
+	var rest []string
+	for name := range cfg.Options {
+		if findOpt(c.Options(), name) == nil {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	for _, name := range append(names, rest...) {
+		if _, err := c.SetOption(name, cfg.Options[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg *ScanConfig) pollInterval() time.Duration {
+	if cfg.PollInterval > 0 {
+		return cfg.PollInterval
+	}
+	return defaultPollInterval
+}
+
+// waitButton blocks until the named sensor option goes from false to true,
+// or until the context is done.
+func (c *Conn) waitButton(ctx context.Context, button string, d time.Duration) error {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	armed := false
+	for {
+		v, err := c.GetOption(button)
+		if err != nil {
+			return err
+		}
+		pressed, ok := v.(bool)
+		if !ok {
+			return &OptionTypeError{button, TypeBool, false}
+		}
+		if pressed && armed {
+			return nil
+		}
+		armed = armed || !pressed // a held button must be released first
+		if c.pollHook != nil {
+			c.pollHook(pressed)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// ButtonScans waits for presses of the named button, which must be a boolean
+// sensor option, and scans an image for each press using cfg. Results are
+// delivered on the returned channel, which is closed when the context is done
+// or after the first error. It returns an OptionTypeError if the option does
+// not hold a single boolean.
+func (c *Conn) ButtonScans(ctx context.Context, button string, cfg ScanConfig) (<-chan ScanResult, error) {
+	o := findOpt(c.Options(), button)
+	if o == nil {
+		return nil, fmt.Errorf("no option named %s", button)
+	}
+	if o.Type != TypeBool || o.Length != 1 {
+		return nil, &OptionTypeError{button, TypeBool, false}
+	}
+	if !o.IsDetectable {
+		return nil, fmt.Errorf("option %s is not a button sensor", button)
+	}
+	ch := make(chan ScanResult)
+	go func() {
+		defer close(ch)
+		for {
+			var r ScanResult
+			if err := c.waitButton(ctx, button, cfg.pollInterval()); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				r.Err = err
+			} else if err := cfg.apply(c); err != nil {
+				r.Err = err
+			} else {
+				r.Image, r.Err = c.ReadImage()
+			}
+			select {
+			case ch <- r:
+			case <-ctx.Done():
+				return
+			}
+			if r.Err != nil {
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// RetryPolicy describes how ReadImageWithPolicy recovers from failed scans.
+type RetryPolicy struct {
+	Attempts   int             // maximum number of attempts, at least 1
+	Delay      time.Duration   // delay between attempts
+	RetryOn    []error         // errors that trigger a retry
+	OnJamEject bool            // retry on ErrJammed after cancelling ejects the sheet
+	OnRetry    func(err error) // called before each retry, if not nil
+}
+
+func (p *RetryPolicy) retries(err error) bool {
+	if err == ErrJammed && p.OnJamEject {
+		return true
+	}
+	for _, e := range p.RetryOn {
+		if err == e {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadImageWithPolicy reads an image from the connection, retrying failed
+// scans as described by p. It returns the error from the last attempt if
+// none succeeds.
+func (c *Conn) ReadImageWithPolicy(p RetryPolicy) (*Image, error) {
+	for i := 1; ; i++ {
+		m, err := c.ReadImage()
+		if err == nil || i >= p.Attempts || !p.retries(err) {
+			return m, err
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(err)
+		}
+		time.Sleep(p.Delay)
+	}
+}
+
+// ScanMeta describes the settings an image was scanned with.
+type ScanMeta struct {
+	Resolution int       // resolution in DPI, 0 if unknown
+	Mode       string    // scan mode, empty if unknown
+	Source     string    // scan source, empty if unknown
+	Device     Device    // scanning device, as returned by DeviceInfo
+	Time       time.Time // time the scan was started
+}
+
+// optString returns the value of the named string option, or the empty string
+// if there is no such option.
+func (c *Conn) optString(name string) string {
+	if o := findOpt(c.Options(), name); o == nil || o.Type != TypeString {
+		return ""
+	}
+	v, err := c.GetOption(name)
+	if err != nil {
+		return ""
+	}
+	return v.(string)
+}
+
+// deviceInfo returns the descriptor of the connected device, listing devices
+// to find it if it was not listed before the connection was opened. Devices
+// are listed at most once per connection, since it may be slow.
+func (c *Conn) deviceInfo() Device {
+	if c.info.Vendor == "" && c.info.Model == "" && !c.listed {
+		c.listed = true
+		if _, err := Devices(); err == nil {
+			c.info = knownDevice(c.Device)
+		}
+	}
+	return c.info
+}
+
+func (c *Conn) meta() ScanMeta {
+	m := ScanMeta{
+		Mode:   c.optString("mode"),
+		Source: c.optString("source"),
+		Device: c.deviceInfo(),
+		Time:   time.Now(),
+	}
+	if dpi, err := c.Resolution(); err == nil {
+		m.Resolution = dpi
+	}
+	return m
+}
+
+// ReadImageWithMeta is like ReadImage, but also returns the settings the image
+// was scanned with.
+func (c *Conn) ReadImageWithMeta() (*Image, ScanMeta, error) {
+	meta := c.meta()
+	m, err := c.ReadImage()
+	if err != nil {
+		return nil, ScanMeta{}, err
+	}
+	return m, meta, nil
+}
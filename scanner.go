@@ -0,0 +1,92 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+// Rect is a rectangular scan area in millimeters, measured from the top left
+// corner of the scan surface.
+type Rect struct {
+	Left, Top, Right, Bottom float64
+}
+
+// Settings holds commonly used scanning options. Zero fields leave the
+// corresponding option unchanged.
+type Settings struct {
+	Mode       string // scan mode, such as "Color" or "Gray"
+	Resolution int    // resolution in DPI, snapped to the nearest supported value
+	Source     string // scan source, such as "Flatbed"
+	Area       *Rect  // scan area
+}
+
+// Scanner is a high-level interface to a scanning device. It takes care of
+// initializing the package and translates Settings to the underlying options.
+// The connection remains available through Conn for finer-grained control.
+type Scanner struct {
+	c *Conn
+}
+
+// NewScanner initializes the package and opens the named device.
+// The empty string opens the first available device.
+func NewScanner(name string) (*Scanner, error) {
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	c, err := Open(name)
+	if err != nil {
+		Exit()
+		return nil, err
+	}
+	return &Scanner{c}, nil
+}
+
+// Conn returns the underlying connection.
+func (s *Scanner) Conn() *Conn {
+	return s.c
+}
+
+// Configure applies the settings to the device. Settings are validated
+// against the device's constraints and applied in an order that accounts
+// for their interdependencies.
+func (s *Scanner) Configure(cfg Settings) error {
+	if cfg.Source != "" {
+		if err := s.c.SetSource(cfg.Source); err != nil {
+			return err
+		}
+	}
+	if cfg.Mode != "" {
+		if err := s.c.setListed("mode", cfg.Mode); err != nil {
+			return err
+		}
+	}
+	if cfg.Resolution != 0 {
+		if _, err := s.c.SetResolution(cfg.Resolution); err != nil {
+			return err
+		}
+	}
+	if cfg.Area != nil {
+		return s.c.SetScanArea(*cfg.Area)
+	}
+	return nil
+}
+
+// Scan scans a single image.
+func (s *Scanner) Scan() (*Image, error) {
+	return s.c.ReadImage()
+}
+
+// ScanAll scans all available images, as with ReadAvailableImages.
+func (s *Scanner) ScanAll() ([]*Image, error) {
+	return s.c.ReadAvailableImages()
+}
+
+// Close closes the device and releases the package. Closing an already
+// closed scanner has no effect; Conn returns nil afterwards.
+func (s *Scanner) Close() {
+	if s.c == nil {
+		return
+	}
+	s.c.Close()
+	s.c = nil
+	Exit()
+}
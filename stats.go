@@ -0,0 +1,101 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import "image/color"
+
+const (
+	blankLevel   = 0.8 // relative luminance below which a pixel is content
+	blankSamples = 256 // maximum number of samples along each axis
+)
+
+// channels returns the number of color channels in the image.
+func (m *Image) channels() int {
+	if m.fs[0].Format == FrameGray {
+		return 1
+	}
+	return 3
+}
+
+// maxSample returns the largest sample value for the image's depth.
+func (m *Image) maxSample() uint16 {
+	return uint16(1<<uint(m.fs[0].Depth) - 1)
+}
+
+// SaturationStats returns the fraction of pixels with a sample at the minimum
+// and at the maximum value for the image's depth. For color images, a pixel
+// counts as clipped if any of its channels is.
+func (m *Image) SaturationStats() (clippedLow, clippedHigh float64) {
+	w, h := m.fs[0].Width, m.fs[0].Height
+	if w == 0 || h == 0 {
+		return 0, 0
+	}
+	max := m.maxSample()
+	nch := m.channels()
+	var low, high int
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			isLow, isHigh := false, false
+			for i := 0; i < nch; i++ {
+				switch m.sampleAt(x, y, i) {
+				case 0:
+					isLow = true
+				case max:
+					isHigh = true
+				}
+			}
+			if isLow {
+				low++
+			}
+			if isHigh {
+				high++
+			}
+		}
+	}
+	n := float64(w * h)
+	return float64(low) / n, float64(high) / n
+}
+
+// Histogram holds the number of pixels with each sample value, scaled to
+// 8 bits, for each channel of an image: one for gray images and three, in
+// RGB order, for color images.
+type Histogram [][256]int
+
+// Histogram returns the histogram of the image. Samples of 1-bit images fall
+// into the first and last buckets, and those of 16-bit images are divided
+// among the buckets by their high byte.
+func (m *Image) Histogram() Histogram {
+	f := m.fs[0]
+	h := make(Histogram, m.channels())
+	for i := range h {
+		for y := 0; y < f.Height; y++ {
+			for x := 0; x < f.Width; x++ {
+				h[i][to8(m.sampleAt(x, y, i), f.Depth)]++
+			}
+		}
+	}
+	return h
+}
+
+// IsBlank reports whether the image looks like a blank page, that is, if the
+// fraction of pixels noticeably darker than a white background is below
+// threshold. Light noise is ignored. The image is sampled along a grid to
+// keep the cost bounded for large scans.
+func (m *Image) IsBlank(threshold float64) bool {
+	b := m.Bounds()
+	dx := (b.Dx() + blankSamples - 1) / blankSamples
+	dy := (b.Dy() + blankSamples - 1) / blankSamples
+	var n, content int
+	for y := 0; y < b.Dy(); y += dy {
+		for x := 0; x < b.Dx(); x += dx {
+			g := color.Gray16Model.Convert(m.At(x, y)).(color.Gray16)
+			if float64(g.Y) < blankLevel*0xffff {
+				content++
+			}
+			n++
+		}
+	}
+	return n == 0 || float64(content)/float64(n) < threshold
+}
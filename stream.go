@@ -0,0 +1,88 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+)
+
+// pageReader reads the raw data of all frames in a page, starting each frame
+// after the previous one ends.
+type pageReader struct {
+	c    *Conn
+	last bool // whether the current frame is the last one
+	eof  bool // whether all frames have been read
+}
+
+func (r *pageReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for !r.eof {
+		n, err := r.c.Read(b)
+		if err != io.EOF {
+			return n, err
+		}
+		if r.last {
+			r.eof = true
+			break
+		}
+		if err := r.c.Start(); err != nil {
+			return 0, err
+		}
+		p, err := r.c.Params()
+		if err != nil {
+			return 0, err
+		}
+		r.last = p.IsLast
+	}
+	return 0, io.EOF
+}
+
+// StreamPages is like ContinuousReadContext, but instead of reading whole
+// images, it calls fn for each page with a reader over its raw frame data and
+// the parameters of its first frame. For three-pass scans, the reader returns
+// the data of each frame in turn. Data not read by the time fn returns is
+// discarded, and the next page is started. If fn returns an error, the scan
+// is cancelled and the error is returned.
+func (c *Conn) StreamPages(ctx context.Context, fn func(i int, r io.Reader, p *Params) error) error {
+	defer c.Cancel()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := c.watch(ctx)
+	err := c.streamPages(ctx, fn)
+	stop()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (c *Conn) streamPages(ctx context.Context, fn func(i int, r io.Reader, p *Params) error) error {
+	for i := 0; ctx.Err() == nil; i++ {
+		if err := c.Start(); err != nil {
+			if err == ErrEmpty && i > 0 {
+				// No more documents in tray
+				return nil
+			}
+			return err
+		}
+		p, err := c.Params()
+		if err != nil {
+			return err
+		}
+		r := &pageReader{c: c, last: p.IsLast}
+		if err := fn(i, r, &p); err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
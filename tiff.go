@@ -0,0 +1,246 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+var (
+	// ErrNoPages is returned by TIFFWriter.Close if no pages were added.
+	ErrNoPages = errors.New("sane: no pages written")
+	// ErrTIFFTooLarge is returned by TIFFWriter.AddPage if the page would
+	// take the file past the 4 GiB that TIFF offsets can address.
+	ErrTIFFTooLarge = errors.New("sane: TIFF file too large")
+	// ErrTIFFClosed is returned by TIFFWriter methods called after Close.
+	ErrTIFFClosed = errors.New("sane: TIFF writer closed")
+)
+
+// TIFFOptions holds options for TIFFWriter.
+type TIFFOptions struct {
+	DPI int // resolution recorded for each page, 0 for none
+}
+
+// TIFF tag types.
+const (
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffRational = 5
+)
+
+// tiffEntry is an entry of a TIFF image file directory. Values that do not
+// fit in the entry are stored in ext.
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	val      uint32
+	ext      []byte
+}
+
+// A TIFFWriter writes a multi-page TIFF file, one page at a time, so that
+// pages can be written as they are scanned without holding them all in
+// memory. Pages are stored uncompressed, with 8- and 16-bit samples as
+// scanned; bilevel gray images stay bilevel, but bilevel color images are
+// stored with 8-bit samples.
+type TIFFWriter struct {
+	w       *bufio.Writer
+	opts    TIFFOptions
+	off     uint32 // number of bytes written
+	pending []byte // directory of the last page, without its next offset
+	err     error
+	closed  bool
+}
+
+// NewTIFFWriter returns a TIFFWriter writing to w with the given options,
+// which may be nil. The TIFF file is complete once Close is called.
+func NewTIFFWriter(w io.Writer, opts *TIFFOptions) *TIFFWriter {
+	t := &TIFFWriter{w: bufio.NewWriter(w)}
+	if opts != nil {
+		t.opts = *opts
+	}
+	return t
+}
+
+func (t *TIFFWriter) write(b []byte) {
+	if t.err == nil {
+		_, t.err = t.w.Write(b)
+		t.off += uint32(len(b))
+	}
+}
+
+// tiffLayout returns the number of samples per pixel, bits per sample and bytes
+// per row used to store m.
+func tiffLayout(m *Image) (spp, bits, rowBytes int) {
+	f := m.fs[0]
+	spp, bits = m.channels(), f.Depth
+	if spp == 3 && bits == 1 {
+		bits = 8
+	}
+	if bits == 1 {
+		return spp, bits, (f.Width + 7) / 8
+	}
+	return spp, bits, f.Width * spp * bits / 8
+}
+
+// AddPage writes m as the next page of the file. It fails with
+// ErrTIFFTooLarge, leaving the file unchanged, if the page does not fit.
+func (t *TIFFWriter) AddPage(m *Image) error {
+	if t.closed {
+		return ErrTIFFClosed
+	}
+	if t.err != nil {
+		return t.err
+	}
+	b := m.Bounds()
+	spp, bits, rowBytes := tiffLayout(m)
+	size64 := uint64(rowBytes) * uint64(b.Dy())
+	end := uint64(t.off) + uint64(len(t.pending)) + size64 + size64%2 +
+		uint64(len(t.directory(b.Dx(), b.Dy(), spp, bits, 0, 0)))
+	if t.off == 0 {
+		end += 8 // header
+	}
+	if end > math.MaxUint32 {
+		return ErrTIFFTooLarge
+	}
+	size := uint32(size64)
+	pad := size % 2 // directories must start on a word boundary
+	if t.off == 0 {
+		header := []byte{'I', 'I', 42, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(header[4:], 8+size+pad)
+		t.write(header)
+	} else {
+		next := t.off + uint32(len(t.pending)) + size + pad
+		t.writePending(next)
+	}
+	dataOff := t.off
+	t.writeData(m, bits, rowBytes)
+	if pad != 0 {
+		t.write([]byte{0})
+	}
+	t.pending = t.directory(b.Dx(), b.Dy(), spp, bits, dataOff, size)
+	return t.err
+}
+
+// writeData writes the samples of m, row by row.
+func (t *TIFFWriter) writeData(m *Image, bits, rowBytes int) {
+	b, d := m.Bounds(), m.fs[0].Depth
+	nch := m.channels()
+	row := make([]byte, rowBytes)
+	for y := 0; y < b.Dy(); y++ {
+		for i := range row {
+			row[i] = 0
+		}
+		for x := 0; x < b.Dx(); x++ {
+			for ch := 0; ch < nch; ch++ {
+				v := m.sampleAt(x, y, ch)
+				switch {
+				case bits == 1:
+					row[x/8] |= uint8(v) << uint(7-x%8) // 1 is white
+				case bits == 16:
+					binary.LittleEndian.PutUint16(row[2*(x*nch+ch):], v)
+				default:
+					row[x*nch+ch] = to8(v, d)
+				}
+			}
+		}
+		t.write(row)
+	}
+}
+
+// directory returns the image file directory of a page whose data is stored
+// at dataOff, with values that do not fit in the entries following it. The
+// directory is to be written at the current offset.
+func (t *TIFFWriter) directory(w, h, spp, bits int, dataOff, size uint32) []byte {
+	photometric := uint32(1) // black is zero
+	if spp == 3 {
+		photometric = 2 // RGB
+	}
+	bps := tiffEntry{tag: 258, typ: tiffShort, count: uint32(spp), val: uint32(bits)}
+	if spp > 1 {
+		bps.ext = make([]byte, 2*spp)
+		for i := 0; i < spp; i++ {
+			binary.LittleEndian.PutUint16(bps.ext[2*i:], uint16(bits))
+		}
+	}
+	entries := []tiffEntry{
+		{tag: 256, typ: tiffLong, count: 1, val: uint32(w)},
+		{tag: 257, typ: tiffLong, count: 1, val: uint32(h)},
+		bps,
+		{tag: 259, typ: tiffShort, count: 1, val: 1}, // no compression
+		{tag: 262, typ: tiffShort, count: 1, val: photometric},
+		{tag: 273, typ: tiffLong, count: 1, val: dataOff},
+		{tag: 277, typ: tiffShort, count: 1, val: uint32(spp)},
+		{tag: 278, typ: tiffLong, count: 1, val: uint32(h)},
+		{tag: 279, typ: tiffLong, count: 1, val: size},
+	}
+	if t.opts.DPI > 0 {
+		res := make([]byte, 8)
+		binary.LittleEndian.PutUint32(res, uint32(t.opts.DPI))
+		binary.LittleEndian.PutUint32(res[4:], 1)
+		entries = append(entries,
+			tiffEntry{tag: 282, typ: tiffRational, count: 1, ext: res},
+			tiffEntry{tag: 283, typ: tiffRational, count: 1, ext: res})
+	}
+	entries = append(entries, tiffEntry{tag: 284, typ: tiffShort, count: 1, val: 1}) // chunky
+	if t.opts.DPI > 0 {
+		entries = append(entries, tiffEntry{tag: 296, typ: tiffShort, count: 1, val: 2}) // inch
+	}
+
+	n := len(entries)
+	dir := make([]byte, 2+12*n)
+	ext := t.off + uint32(len(dir)) + 4 // after the next directory offset
+	var extra []byte
+	binary.LittleEndian.PutUint16(dir, uint16(n))
+	for i, e := range entries {
+		p := dir[2+12*i:]
+		binary.LittleEndian.PutUint16(p, e.tag)
+		binary.LittleEndian.PutUint16(p[2:], e.typ)
+		binary.LittleEndian.PutUint32(p[4:], e.count)
+		switch {
+		case e.ext != nil:
+			binary.LittleEndian.PutUint32(p[8:], ext+uint32(len(extra)))
+			extra = append(extra, e.ext...)
+		case e.typ == tiffShort:
+			binary.LittleEndian.PutUint16(p[8:], uint16(e.val))
+		default:
+			binary.LittleEndian.PutUint32(p[8:], e.val)
+		}
+	}
+	return append(append(dir, 0, 0, 0, 0), extra...)
+}
+
+// writePending writes the directory of the last page, pointing to the next
+// one at offset next, or 0 if it is the last page.
+func (t *TIFFWriter) writePending(next uint32) {
+	n := binary.LittleEndian.Uint16(t.pending)
+	binary.LittleEndian.PutUint32(t.pending[2+12*int(n):], next)
+	t.write(t.pending)
+	t.pending = nil
+}
+
+// Close completes the TIFF file. It does not close the underlying writer. It
+// returns ErrNoPages if no pages were added, since a TIFF file must have at
+// least one, and ErrTIFFClosed if called more than once.
+func (t *TIFFWriter) Close() error {
+	if t.closed {
+		return ErrTIFFClosed
+	}
+	t.closed = true
+	if t.err != nil {
+		return t.err
+	}
+	if t.pending == nil {
+		return ErrNoPages
+	}
+	t.writePending(0)
+	if t.err != nil {
+		return t.err
+	}
+	return t.w.Flush()
+}
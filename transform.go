@@ -0,0 +1,104 @@
+// Copyright (C) 2013 Tiago Quelhas. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sane
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// remap returns a new w x h image where the pixel at (x,y) is taken from the
+// pixel of m at src(x,y). Samples are copied as is, so bit depth is preserved.
+func (m *Image) remap(w, h int, src func(x, y int) (int, int)) *Image {
+	return m.mapFrames(func(f *Frame) *Frame {
+		g := newFrame(f, w, h)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				sx, sy := src(x, y)
+				for ch := 0; ch < f.Channels; ch++ {
+					g.set(x, y, ch, f.AtUnchecked(sx, sy, ch))
+				}
+			}
+		}
+		return g
+	})
+}
+
+// Rotate returns a copy of the image rotated clockwise by deg degrees, which
+// must be a multiple of 90.
+func (m *Image) Rotate(deg int) (*Image, error) {
+	w, h := m.fs[0].Width, m.fs[0].Height
+	switch (deg%360 + 360) % 360 {
+	case 0:
+		return m.remap(w, h, func(x, y int) (int, int) {
+			return x, y
+		}), nil
+	case 90:
+		return m.remap(h, w, func(x, y int) (int, int) {
+			return y, h - 1 - x
+		}), nil
+	case 180:
+		return m.remap(w, h, func(x, y int) (int, int) {
+			return w - 1 - x, h - 1 - y
+		}), nil
+	case 270:
+		return m.remap(h, w, func(x, y int) (int, int) {
+			return w - 1 - y, x
+		}), nil
+	}
+	return nil, fmt.Errorf("unsupported rotation: %d degrees", deg)
+}
+
+// FlipH returns a copy of the image mirrored horizontally, as needed for the
+// backs of some duplex scans.
+func (m *Image) FlipH() *Image {
+	w, h := m.fs[0].Width, m.fs[0].Height
+	return m.remap(w, h, func(x, y int) (int, int) {
+		return w - 1 - x, y
+	})
+}
+
+// FlipV returns a copy of the image mirrored vertically.
+func (m *Image) FlipV() *Image {
+	return m.mapFrames(func(f *Frame) *Frame {
+		g := newFrame(f, f.Width, f.Height)
+		for y := 0; y < f.Height; y++ {
+			copyRect(g, image.Pt(0, f.Height-1-y), f, image.Rect(0, y, f.Width, y+1))
+		}
+		return g
+	})
+}
+
+// AutoCrop returns the smallest part of the image holding all pixels that
+// differ from the background color bg, as with SubImage. A pixel differs if
+// any of its channels differs from bg by more than tolerance, as a fraction
+// of the full sample range, which allows for scanner noise. If no pixel
+// differs, an empty image is returned.
+func (m *Image) AutoCrop(bg color.Color, tolerance float64) *Image {
+	d := m.fs[0].Depth
+	s := m.samples(bg)
+	limit := tolerance * 0xffff
+	nch := m.channels()
+	isBg := func(x, y int) bool {
+		for i := 0; i < nch; i++ {
+			v, b := float64(to16(m.sampleAt(x, y, i), d)), float64(to16(s[i], d))
+			if v-b > limit || b-v > limit {
+				return false
+			}
+		}
+		return true
+	}
+	w, h := m.fs[0].Width, m.fs[0].Height
+	r := image.Rectangle{}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if !isBg(x, y) {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return m.SubImage(r)
+}